@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NewAddressBook creates an empty address book that will be saved to path.
+func NewAddressBook(path string) *AddressBook {
+	book := &AddressBook{
+		Mutex:   new(sync.Mutex),
+		Path:    path,
+		Entries: make(map[string]*AddressEntry),
+	}
+	rand.Read(book.Key[:])
+	return book
+}
+
+// LoadAddressBook reads the address book stored at path, or starts an empty one if the file does not exist yet.
+func LoadAddressBook(path string) (*AddressBook, error) {
+	book := NewAddressBook(path)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		Log(DEBUG, "no address book found, starting a new one")
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, book); err != nil {
+		return nil, fmt.Errorf("failed to parse address book %s: %w", path, err)
+	}
+	if book.Entries == nil {
+		book.Entries = make(map[string]*AddressEntry)
+	}
+	Log(DEBUG, fmt.Sprintf("loaded %d addresses from %s", len(book.Entries), path))
+	return book, nil
+}
+
+// Save writes the address book to its file, replacing the previous copy atomically.
+func (ab *AddressBook) Save() error {
+	ab.Mutex.Lock()
+	data, err := json.MarshalIndent(ab, "", "  ")
+	ab.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := ab.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ab.Path)
+}
+
+// SaveEvery writes the address book to disk every interval until ctx is cancelled.
+func (ab *AddressBook) SaveEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := ab.Save(); err != nil {
+			Log(ERROR, fmt.Sprintf("failed to save address book: %v", err))
+		}
+	}
+}
+
+// AddressKey returns the key an address is stored under.
+func AddressKey(address net.IP, port uint16) string {
+	return net.JoinHostPort(address.String(), strconv.Itoa(int(port)))
+}
+
+// Add records a peer we heard about from source. Addresses we have already connected to stay in their tried bucket.
+// Anyone can sign a record for any address, so a newer record only refreshes an entry of the same node. A record of
+// another node only takes over an address we haven't connected to, and never one we have.
+func (ab *AddressBook) Add(record PeerRecord, source net.IP) {
+	if !record.Dialable() {
+		return
+	}
+
+	ab.Mutex.Lock()
+	defer ab.Mutex.Unlock()
+
+	key := AddressKey(record.Address, record.Port)
+	if entry, exists := ab.Entries[key]; exists {
+		newer := entry.Record == nil || record.LastSeen.After(entry.Record.LastSeen)
+		if record.NodeID != entry.NodeID {
+			if !entry.Tried && newer {
+				entry.NodeID = record.NodeID
+				entry.Record = &record
+				entry.LastSeen = record.LastSeen
+			}
+			return
+		}
+		if newer {
+			entry.Record = &record
+		}
+		if record.LastSeen.After(entry.LastSeen) {
+			entry.LastSeen = record.LastSeen
+		}
+		return
+	}
+
+	ab.addLocked(key, &AddressEntry{
+		Address:  record.Address,
+		Port:     record.Port,
+		NodeID:   record.NodeID,
+		Record:   &record,
+		Source:   source,
+		LastSeen: record.LastSeen,
+	})
+}
+
+// AddObserved records a peer whose record carries no address at the address it was seen connecting from,
+// by us or by source. As the peer didn't sign that address it only ever adds a new entry and never changes
+// one we have. It returns whether the entry was added.
+func (ab *AddressBook) AddObserved(record PeerRecord, address net.IP, source net.IP) bool {
+	if record.Address != nil || address == nil || address.IsUnspecified() || record.Port == 0 {
+		return false
+	}
+
+	ab.Mutex.Lock()
+	defer ab.Mutex.Unlock()
+
+	key := AddressKey(address, record.Port)
+	if _, exists := ab.Entries[key]; exists {
+		return false
+	}
+	ab.addLocked(key, &AddressEntry{
+		Address:  address,
+		Port:     record.Port,
+		NodeID:   record.NodeID,
+		Record:   &record,
+		Source:   source,
+		LastSeen: record.LastSeen,
+	})
+	return true
+}
+
+// addLocked puts a new entry into its new bucket, making room for it. The caller must hold ab.Mutex.
+func (ab *AddressBook) addLocked(key string, entry *AddressEntry) {
+	entry.Bucket = ab.newBucket(entry)
+	ab.makeRoom(false, entry.Bucket)
+	ab.Entries[key] = entry
+}
+
+// MarkAttempt records that we are about to dial an address.
+func (ab *AddressBook) MarkAttempt(address net.IP, port uint16) {
+	ab.Mutex.Lock()
+	defer ab.Mutex.Unlock()
+
+	key := AddressKey(address, port)
+	entry, exists := ab.Entries[key]
+	if !exists {
+		entry = &AddressEntry{Address: address, Port: port}
+		entry.Bucket = ab.newBucket(entry)
+		ab.makeRoom(false, entry.Bucket)
+		ab.Entries[key] = entry
+	}
+	entry.LastAttempt = time.Now()
+}
+
+// MarkSuccess records a successful connection and moves the address into a tried bucket.
+func (ab *AddressBook) MarkSuccess(address net.IP, port uint16, nodeID NodeID, record *PeerRecord) {
+	ab.Mutex.Lock()
+	defer ab.Mutex.Unlock()
+
+	key := AddressKey(address, port)
+	entry, exists := ab.Entries[key]
+	if !exists {
+		entry = &AddressEntry{Address: address, Port: port}
+		ab.Entries[key] = entry
+	}
+
+	now := time.Now()
+	if nodeID != "" {
+		entry.NodeID = nodeID
+	}
+	if record != nil {
+		entry.Record = record
+	}
+	entry.Successes++
+	entry.ConsecutiveFailures = 0
+	entry.LastSuccess = now
+	entry.LastSeen = now
+
+	if !entry.Tried {
+		bucket := ab.triedBucket(entry)
+		ab.makeRoom(true, bucket)
+		entry.Tried = true
+		entry.Bucket = bucket
+	}
+}
+
+// MarkFailure records a failed connection. Addresses that never worked are forgotten after MaxAddressFailures attempts.
+func (ab *AddressBook) MarkFailure(address net.IP, port uint16) {
+	ab.Mutex.Lock()
+	defer ab.Mutex.Unlock()
+
+	key := AddressKey(address, port)
+	entry, exists := ab.Entries[key]
+	if !exists {
+		return
+	}
+
+	entry.Failures++
+	entry.ConsecutiveFailures++
+	if !entry.Tried && entry.ConsecutiveFailures >= MaxAddressFailures {
+		delete(ab.Entries, key)
+	}
+}
+
+// Remove forgets an address.
+func (ab *AddressBook) Remove(address net.IP, port uint16) {
+	ab.Mutex.Lock()
+	defer ab.Mutex.Unlock()
+
+	delete(ab.Entries, AddressKey(address, port))
+}
+
+// NextAttempt returns the earliest time we should dial this address again.
+func (e *AddressEntry) NextAttempt() time.Time {
+	if e.ConsecutiveFailures == 0 {
+		return e.LastAttempt
+	}
+
+	backoff := ReconnectBackoffBase
+	for i := uint(1); i < e.ConsecutiveFailures && backoff < ReconnectBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > ReconnectBackoffMax {
+		backoff = ReconnectBackoffMax
+	}
+	return e.LastAttempt.Add(backoff)
+}
+
+// Score ranks how likely this address is to give us a good connection. Higher is better.
+func (e *AddressEntry) Score() float64 {
+	score := float64(e.Successes+1) / float64(e.Successes+e.Failures+2)
+	if e.Tried {
+		score += 1
+	}
+
+	// Prefer addresses we have heard from recently
+	age := time.Since(e.LastSeen)
+	if age > PeerRecordTTL {
+		score -= 0.5
+	}
+	return score
+}
+
+// Candidates returns up to n addresses whose backoff has expired, best first.
+// Addresses for which skip returns true are left out.
+func (ab *AddressBook) Candidates(n int, skip func(entry *AddressEntry) bool) []AddressEntry {
+	ab.Mutex.Lock()
+	defer ab.Mutex.Unlock()
+
+	now := time.Now()
+	entries := make([]*AddressEntry, 0, len(ab.Entries))
+	for _, entry := range ab.Entries {
+		if entry.NextAttempt().After(now) {
+			continue
+		}
+		if skip != nil && skip(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Score() > entries[j].Score()
+	})
+
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	candidates := make([]AddressEntry, len(entries))
+	for i, entry := range entries {
+		candidates[i] = *entry
+	}
+	return candidates
+}
+
+// makeRoom evicts the weakest entry from a full bucket. Entries evicted from a tried bucket are moved
+// back to the new table rather than forgotten, evicting from their new bucket in turn. The caller must hold ab.Mutex.
+func (ab *AddressBook) makeRoom(tried bool, bucket int) {
+	var worstKey string
+	var worst *AddressEntry
+	count := 0
+	for key, entry := range ab.Entries {
+		if entry.Tried != tried || entry.Bucket != bucket {
+			continue
+		}
+		count++
+		if worst == nil || entry.Score() < worst.Score() {
+			worstKey, worst = key, entry
+		}
+	}
+	if count < BucketSize {
+		return
+	}
+
+	if tried {
+		// The new bucket it goes back to may be full too, and has to make room first
+		bucket := ab.newBucket(worst)
+		ab.makeRoom(false, bucket)
+		worst.Tried = false
+		worst.Bucket = bucket
+		return
+	}
+	delete(ab.Entries, worstKey)
+}
+
+// newBucket picks the new bucket for an entry from the network groups of the address and of whoever told us about it,
+// so that a single source cannot fill the whole table. The caller must hold ab.Mutex.
+func (ab *AddressBook) newBucket(entry *AddressEntry) int {
+	h := sha256.New()
+	h.Write(ab.Key[:])
+	h.Write(NetworkGroup(entry.Source))
+	h.Write(NetworkGroup(entry.Address))
+	return int(binary.LittleEndian.Uint64(h.Sum(nil)) % NewBucketCount)
+}
+
+// triedBucket picks the tried bucket for an entry. The caller must hold ab.Mutex.
+func (ab *AddressBook) triedBucket(entry *AddressEntry) int {
+	h := sha256.New()
+	h.Write(ab.Key[:])
+	h.Write(NetworkGroup(entry.Address))
+	h.Write([]byte(AddressKey(entry.Address, entry.Port)))
+	return int(binary.LittleEndian.Uint64(h.Sum(nil)) % TriedBucketCount)
+}
+
+// NetworkGroup returns the prefix that addresses under common control tend to share:
+// the /16 for IPv4 and the /32 for IPv6.
+func NetworkGroup(ip net.IP) []byte {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[:2]
+	}
+	return ip.To16()[:4]
+}
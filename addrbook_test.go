@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddressBookDemotionMakesRoom(t *testing.T) {
+	ab := NewAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	now := time.Now()
+
+	// A full tried bucket whose weakest entry has failed more than the others
+	var worst *AddressEntry
+	for i := 0; i < BucketSize; i++ {
+		entry := &AddressEntry{
+			Address:   net.IPv4(10, byte(i), 0, 1),
+			Port:      19876,
+			Tried:     true,
+			Successes: 10,
+			LastSeen:  now,
+		}
+		if i == 0 {
+			entry.Failures = 10
+			worst = entry
+		}
+		ab.Entries[AddressKey(entry.Address, entry.Port)] = entry
+	}
+
+	// ... and a full new bucket for it to go back to
+	bucket := ab.newBucket(worst)
+	for i := 0; i < BucketSize; i++ {
+		entry := &AddressEntry{
+			Address:  net.ParseIP(fmt.Sprintf("fd00::%x", i+1)),
+			Port:     19876,
+			Bucket:   bucket,
+			LastSeen: now,
+		}
+		ab.Entries[AddressKey(entry.Address, entry.Port)] = entry
+	}
+
+	ab.Mutex.Lock()
+	ab.makeRoom(true, 0)
+	ab.Mutex.Unlock()
+
+	if worst.Tried || worst.Bucket != bucket {
+		t.Fatal("weakest tried entry was not moved back to its new bucket")
+	}
+	tried, inBucket := 0, 0
+	for _, entry := range ab.Entries {
+		switch {
+		case entry.Tried:
+			tried++
+		case entry.Bucket == bucket:
+			inBucket++
+		}
+	}
+	if tried != BucketSize-1 {
+		t.Fatalf("tried bucket holds %d entries, want %d", tried, BucketSize-1)
+	}
+	if inBucket != BucketSize {
+		t.Fatalf("new bucket holds %d entries, want %d", inBucket, BucketSize)
+	}
+}
+
+func TestAddressBookKeepsTriedIdentity(t *testing.T) {
+	ab := NewAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	address := net.IPv4(10, 1, 0, 1)
+	record := func(at time.Time) PeerRecord {
+		keys, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := PeerRecord{NodeID: NodeIDFromKey(keys.PublicKey), PublicKey: keys.PublicKey, Address: address, Port: 19876, LastSeen: at}
+		if err := r.Sign(keys.PrivateKey); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	key := AddressKey(address, 19876)
+
+	// Until we have connected, a newer record of another node takes over the address
+	first := record(time.Now().Add(-time.Hour))
+	ab.Add(first, nil)
+	second := record(time.Now().Add(-time.Minute))
+	ab.Add(second, nil)
+	if ab.Entries[key].NodeID != second.NodeID {
+		t.Fatal("newer record did not replace the one of an address we never connected to")
+	}
+
+	// Once we have, it belongs to the node we found there
+	ab.MarkSuccess(address, 19876, second.NodeID, &second)
+	seen := ab.Entries[key].LastSeen
+	intruder := record(time.Now())
+	ab.Add(intruder, nil)
+	if entry := ab.Entries[key]; entry.NodeID != second.NodeID || entry.Record.NodeID != second.NodeID || !entry.LastSeen.Equal(seen) {
+		t.Fatal("record of another node changed an address we have connected to")
+	}
+}
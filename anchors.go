@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// LoadAnchors reads the anchor addresses saved by our previous run. A missing file means we have none.
+func LoadAnchors(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var anchors []string
+	if err := json.Unmarshal(data, &anchors); err != nil {
+		return nil, fmt.Errorf("failed to parse anchors %s: %w", path, err)
+	}
+	return anchors, nil
+}
+
+// SaveAnchors writes anchors to path, replacing the previous copy atomically.
+func SaveAnchors(path string, anchors []string) error {
+	data, err := json.MarshalIndent(anchors, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ConnectToAnchors dials the anchors saved in path in parallel. Peers that stayed connected to us
+// longest are the hardest for an attacker to have planted, so we reconnect to them before trusting
+// whatever our address book was filled with while we were down.
+func (pm *PeerManager) ConnectToAnchors(path string) {
+	anchors, err := LoadAnchors(path)
+	if err != nil {
+		Log(ERROR, fmt.Sprintf("failed to load anchors: %v", err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, anchor := range anchors {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			ip, anchorPort, err := ResolvePeerAddress(address)
+			if err == nil {
+				_, err = pm.ConnectToPeer(ip, anchorPort)
+			}
+			if err != nil {
+				Log(DEBUG, fmt.Sprintf("failed to reconnect to anchor %s: %v", address, err))
+				return
+			}
+			Log(INFO, fmt.Sprintf("reconnected to anchor %s", address))
+		}(anchor)
+	}
+	wg.Wait()
+}
+
+// RunAnchors keeps the anchors in path up to date with our MaxAnchors longest lived outbound peers.
+// The file is only rewritten while we have outbound peers and stops changing once we start shutting down,
+// so losing our connections on the way down doesn't throw away the anchors for our next run.
+func (pm *PeerManager) RunAnchors(path string) {
+	events, unsubscribe := pm.Peers.Subscribe()
+	defer unsubscribe()
+
+	var saved []string
+	for {
+		select {
+		case <-pm.Context.Done():
+			return
+		case <-events:
+		}
+		if pm.Context.Err() != nil {
+			return
+		}
+
+		anchors := pm.Anchors()
+		if len(anchors) == 0 || equalStrings(anchors, saved) {
+			continue
+		}
+		if err := SaveAnchors(path, anchors); err != nil {
+			Log(ERROR, fmt.Sprintf("failed to save anchors: %v", err))
+			continue
+		}
+		saved = anchors
+	}
+}
+
+// Anchors returns the addresses of our MaxAnchors longest lived outbound peers.
+func (pm *PeerManager) Anchors() []string {
+	outbound := make([]*Peer, 0)
+	for _, peer := range pm.Peers.List() {
+		if !peer.Inbound {
+			outbound = append(outbound, peer)
+		}
+	}
+	sort.Slice(outbound, func(i, j int) bool {
+		return outbound[i].Connected.Before(outbound[j].Connected)
+	})
+	if len(outbound) > MaxAnchors {
+		outbound = outbound[:MaxAnchors]
+	}
+
+	anchors := make([]string, len(outbound))
+	for i, peer := range outbound {
+		anchors[i] = AddressKey(peer.Address, peer.Port)
+	}
+	return anchors
+}
+
+// equalStrings reports whether a and b hold the same strings in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
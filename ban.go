@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewBanList creates an empty ban list that will be saved to path.
+func NewBanList(path string) *BanList {
+	return &BanList{
+		Mutex:    new(sync.Mutex),
+		Path:     path,
+		Bans:     make(map[string]*Ban),
+		IPScores: make(map[string]*IPScore),
+	}
+}
+
+// LoadBanList reads the bans stored at path, or starts an empty list if the file does not exist yet.
+// Bans that have already expired are dropped.
+func LoadBanList(path string) (*BanList, error) {
+	bans := NewBanList(path)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bans, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, bans); err != nil {
+		return nil, fmt.Errorf("failed to parse ban list %s: %w", path, err)
+	}
+	if bans.Bans == nil {
+		bans.Bans = make(map[string]*Ban)
+	}
+
+	bans.Mutex.Lock()
+	bans.pruneLocked(time.Now())
+	bans.Mutex.Unlock()
+	return bans, nil
+}
+
+// Save writes the ban list to its file, replacing the previous copy atomically.
+func (bl *BanList) Save() error {
+	bl.Mutex.Lock()
+	data, err := json.MarshalIndent(bl, "", "  ")
+	bl.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := bl.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bl.Path)
+}
+
+// IsBanned reports whether ip is currently banned.
+func (bl *BanList) IsBanned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	bl.Mutex.Lock()
+	defer bl.Mutex.Unlock()
+
+	ban, exists := bl.Bans[ip.String()]
+	return exists && time.Now().Before(ban.Expires)
+}
+
+// Ban bans ip for duration and saves the ban list.
+func (bl *BanList) Ban(ip net.IP, duration time.Duration, reason string) {
+	now := time.Now()
+
+	bl.Mutex.Lock()
+	bl.Bans[ip.String()] = &Ban{
+		Address: ip.String(),
+		Reason:  reason,
+		Created: now,
+		Expires: now.Add(duration),
+	}
+	delete(bl.IPScores, ip.String())
+	bl.Mutex.Unlock()
+
+	if err := bl.Save(); err != nil {
+		Log(ERROR, fmt.Sprintf("failed to save ban list: %v", err))
+	}
+}
+
+// List returns the active bans, soonest to expire first.
+func (bl *BanList) List() []Ban {
+	bl.Mutex.Lock()
+	defer bl.Mutex.Unlock()
+
+	bl.pruneLocked(time.Now())
+	bans := make([]Ban, 0, len(bl.Bans))
+	for _, ban := range bl.Bans {
+		bans = append(bans, *ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Expires.Before(bans[j].Expires)
+	})
+	return bans
+}
+
+// Clear lifts the ban on address, or every ban if address is empty. It returns how many bans were lifted.
+func (bl *BanList) Clear(address string) (int, error) {
+	bl.Mutex.Lock()
+	cleared := 0
+	if address == "" {
+		cleared = len(bl.Bans)
+		bl.Bans = make(map[string]*Ban)
+		bl.IPScores = make(map[string]*IPScore)
+	} else {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			bl.Mutex.Unlock()
+			return 0, fmt.Errorf("invalid IP address %q", address)
+		}
+		if _, exists := bl.Bans[ip.String()]; exists {
+			delete(bl.Bans, ip.String())
+			cleared = 1
+		}
+		delete(bl.IPScores, ip.String())
+	}
+	bl.Mutex.Unlock()
+
+	return cleared, bl.Save()
+}
+
+// addPoints charges points to both the connection's and the IP's misbehavior score and
+// returns the new scores. IP scores decay by ScoreDecayPerHour.
+func (bl *BanList) addPoints(p *Peer, points int) (int, int) {
+	bl.Mutex.Lock()
+	defer bl.Mutex.Unlock()
+
+	now := time.Now()
+	key := p.Address.String()
+	score, exists := bl.IPScores[key]
+	if !exists {
+		score = &IPScore{}
+		bl.IPScores[key] = score
+	}
+	decay := int(now.Sub(score.Updated).Hours() * ScoreDecayPerHour)
+	if score.Points -= decay; score.Points < 0 {
+		score.Points = 0
+	}
+	score.Points += points
+	score.Updated = now
+
+	p.Score += points
+	return p.Score, score.Points
+}
+
+// pruneLocked drops expired bans. The caller must hold bl.Mutex.
+func (bl *BanList) pruneLocked(now time.Time) {
+	for address, ban := range bl.Bans {
+		if !now.Before(ban.Expires) {
+			delete(bl.Bans, address)
+		}
+	}
+}
+
+// Misbehaving charges a peer for an offense. Once the connection or its IP reaches BanThreshold
+// the IP is banned and every connection from it is closed.
+func (pm *PeerManager) Misbehaving(p *Peer, offense Offense, reason string) {
+	points := Penalties[offense]
+	peerScore, ipScore := pm.Bans.addPoints(p, points)
+	Log(WARNING, fmt.Sprintf("peer %s (%s) misbehaved: %s: %s (+%d, peer score %d, ip score %d)", p.NodeID, p.Address, offense, reason, points, peerScore, ipScore))
+
+	if peerScore < BanThreshold && ipScore < BanThreshold {
+		return
+	}
+	if p.Address == nil {
+		p.Close()
+		return
+	}
+
+	Log(WARNING, fmt.Sprintf("banning %s for %v: %s", p.Address, banDuration, offense))
+	pm.Bans.Ban(p.Address, banDuration, string(offense))
+	pm.disconnectIP(p.Address)
+	p.Close()
+}
+
+// disconnectIP closes every connection from ip.
+func (pm *PeerManager) disconnectIP(ip net.IP) {
+	for _, peer := range pm.Peers.List() {
+		if peer.Address.Equal(ip) {
+			peer.Close()
+		}
+	}
+}
@@ -13,6 +13,16 @@ func (b *Block) Validate() error {
 	// Compute the hash of the block
 	blockHash := b.Hash()
 
+	if b.BlockHash != blockHash {
+		return errors.New("block hash does not match block contents")
+	}
+	if b.Version >= BlockVersionWork && !MeetsTarget(blockHash, b.Target) {
+		return errors.New("block hash does not meet its proof of work target")
+	}
+	if b.Version < BlockVersionMerkle && b.Vote != (AuthorityVote{}) {
+		return errors.New("block version 0 cannot carry an authority vote")
+	}
+
 	// Verify the signature of the block
 	if !ed25519.Verify(ed25519.PublicKey(b.Issuer[:]), blockHash[:], b.Signature[:]) {
 		return errors.New("block signature is invalid")
@@ -39,23 +49,106 @@ func (b *Block) Validate() error {
 }
 
 func (b *Block) Hash() Hash {
-	h := sha256.New()
+	header := b.Header()
+	return header.Hash()
+}
+
+// Header returns the block without its transactions. The header still commits to them through TxHashes,
+// or through TxRoot from BlockVersionMerkle on.
+func (b *Block) Header() BlockHeader {
+	txHashes := make([]Hash, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		txHashes[i] = tx.Hash()
+	}
+	header := BlockHeader{
+		Height:     b.Height,
+		Nonce:      b.Nonce,
+		BlockHash:  b.BlockHash,
+		ParentHash: b.ParentHash,
+		Version:    b.Version,
+		Timestamp:  b.Timestamp,
+		Issuer:     b.Issuer,
+		Signature:  b.Signature,
+		TxHashes:   txHashes,
+	}
+	if b.Version >= BlockVersionMerkle {
+		header.TxRoot = MerkleRoot(txHashes)
+		header.StateRoot = b.StateRoot
+		header.Vote = b.Vote
+	}
+	if b.Version >= BlockVersionWork {
+		header.Target = b.Target
+	}
+	return header
+}
+
+// Hash computes the block hash from the header. It matches the hash of the full block.
+func (h *BlockHeader) Hash() Hash {
+	hasher := sha256.New()
 
 	// Add block fields to hash
-	binary.Write(h, binary.LittleEndian, b.Height)
-	h.Write(b.Nonce[:])
-	h.Write(b.ParentHash[:])
-	binary.Write(h, binary.LittleEndian, b.Version)
-	binary.Write(h, binary.LittleEndian, b.Timestamp.Unix())
-	h.Write(b.Issuer[:])
+	binary.Write(hasher, binary.LittleEndian, h.Height)
+	hasher.Write(h.Nonce[:])
+	hasher.Write(h.ParentHash[:])
+	binary.Write(hasher, binary.LittleEndian, h.Version)
+	binary.Write(hasher, binary.LittleEndian, h.Timestamp.Unix())
+	hasher.Write(h.Issuer[:])
+
+	// Add the Merkle roots, so a header without its TxHashes can still be checked
+	if h.Version >= BlockVersionMerkle {
+		hasher.Write(h.TxRoot[:])
+		hasher.Write(h.StateRoot[:])
+		if h.Version >= BlockVersionWork {
+			hasher.Write(h.Target[:])
+		}
+		// A vote is only hashed when there is one, so blocks without one keep their hash
+		if h.Vote != (AuthorityVote{}) {
+			hasher.Write(h.Vote.Key[:])
+			binary.Write(hasher, binary.LittleEndian, h.Vote.Weight)
+		}
+		return Hash(sha256.Sum256(hasher.Sum(nil)))
+	}
 
 	// Add each transaction hash to block hash
-	for _, tx := range b.Transactions {
-		txHash := tx.Hash()
-		h.Write(txHash[:])
+	for _, txHash := range h.TxHashes {
+		hasher.Write(txHash[:])
+	}
+
+	return Hash(sha256.Sum256(hasher.Sum(nil)))
+}
+
+// Validate checks the header's hash and the issuer's signature. The transactions themselves can only be checked against the full block.
+// From BlockVersionMerkle on the TxHashes may be left out, as light clients get them, but if present they must match TxRoot.
+func (h *BlockHeader) Validate() error {
+	blockHash := h.Hash()
+
+	if h.BlockHash != blockHash {
+		return errors.New("block hash does not match header contents")
+	}
+	if h.Version >= BlockVersionWork && !MeetsTarget(blockHash, h.Target) {
+		return errors.New("block hash does not meet its proof of work target")
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(h.Issuer[:]), blockHash[:], h.Signature[:]) {
+		return errors.New("block signature is invalid")
+	}
+
+	if h.Height < 1 {
+		return errors.New("block height must be greater than zero")
 	}
 
-	return Hash(sha256.Sum256(h.Sum(nil)))
+	if h.Version >= BlockVersionMerkle {
+		if len(h.TxHashes) > 0 && MerkleRoot(h.TxHashes) != h.TxRoot {
+			return errors.New("transaction hashes do not match header TxRoot")
+		}
+		return nil
+	}
+
+	if len(h.TxHashes) == 0 {
+		return errors.New("block must have at least one transaction")
+	}
+
+	return nil
 }
 
 func (b *Block) Sign(key PrivateKey) error {
@@ -64,7 +157,11 @@ func (b *Block) Sign(key PrivateKey) error {
 	if err != nil {
 		return err
 	}
+	return b.signHash(key)
+}
 
+// signHash signs the block as it is, leaving the nonce alone.
+func (b *Block) signHash(key PrivateKey) error {
 	// Compute the hash of the block
 	blockHash := b.Hash()
 
@@ -76,8 +173,9 @@ func (b *Block) Sign(key PrivateKey) error {
 		return errors.New("signature generation failed")
 	}
 
-	// Copy the signature into the block
+	// Copy the signature and hash into the block
 	copy(b.Signature[:], signature)
+	b.BlockHash = blockHash
 
 	return nil
 }
@@ -1,23 +1,85 @@
 package main
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 	"sort"
 	"time"
 )
 
+var (
+	ErrInvalidBlock       = errors.New("invalid block")
+	ErrInvalidTransaction = errors.New("invalid transaction")
+
+	// ErrBlockFromFuture is returned by a consensus for a block that may be valid but not yet, so it isn't an ErrInvalidBlock
+	ErrBlockFromFuture = errors.New("block timestamp is too far in the future")
+)
+
+// AddBlock adds a block to the chain. A block that doesn't extend our tip is kept as a side chain block
+// if our consensus has fork choice, and becomes part of our chain once its branch has the most work.
 func (c *Chain) AddBlock(block Block) error {
 	err := block.Validate()
 	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	// The block must extend our current tip, unless it can start or extend a side chain
+	if block.Height != uint64(len(c.BlockHistory)+1) || block.ParentHash != c.tipHash() {
+		if c.allowsForksLocked() {
+			return c.addSideBlockLocked(block)
+		}
+		if block.Height != uint64(len(c.BlockHistory)+1) {
+			return fmt.Errorf("block height %d does not extend chain at height %d", block.Height, len(c.BlockHistory))
+		}
+		return errors.New("block parent does not match chain tip")
+	}
+
+	if err := c.verifyLocked(&block); err != nil {
+		return err
+	}
+	if err := c.extendLocked(block); err != nil {
+		return err
+	}
+	c.pruneSideLocked()
+	return nil
+}
+
+// verifyLocked checks a block against our consensus. Its errors are ErrInvalidBlock, except
+// ErrBlockFromFuture for a block that may be accepted later. The caller must hold c.Mutex.
+func (c *Chain) verifyLocked(block *Block) error {
+	err := c.Consensus.Verify(c, block)
+	if err == nil || errors.Is(err, ErrBlockFromFuture) {
 		return err
 	}
-	c.BlockHistory = append(c.BlockHistory, block)
+	return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+}
+
+// extendLocked moves the account state on by a block that extends our tip and appends it.
+// The caller must hold c.Mutex.
+func (c *Chain) extendLocked(block Block) error {
+	state := c.nextState(&block)
+	if block.Version >= BlockVersionMerkle && StateRoot(state) != block.StateRoot {
+		return fmt.Errorf("%w: state root does not match the state after the block", ErrInvalidBlock)
+	}
+	c.appendBlock(block, state)
+
+	// Drop any pending transactions that this block has confirmed
+	c.removePending(block.Transactions)
 	return nil
 }
 
 func (c *Chain) Validate() error {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
 	for _, block := range c.BlockHistory {
 		err := block.Validate()
 		if err != nil {
@@ -27,19 +89,79 @@ func (c *Chain) Validate() error {
 	return nil
 }
 
+// LoadChain replays the blocks and pending transactions saved in path onto a new chain.
+// A missing file gives an empty chain.
+func LoadChain(path string) (*Chain, error) {
+	chain := initChain()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return chain, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state ChainState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse chain %s: %w", path, err)
+	}
+	for _, block := range state.Blocks {
+		if err := chain.AddBlock(block); err != nil {
+			return nil, fmt.Errorf("failed to load block %d from %s: %w", block.Height, path, err)
+		}
+	}
+	for _, tx := range state.Pending {
+		if err := chain.AddTransaction(tx); err != nil {
+			Log(WARNING, fmt.Sprintf("dropping saved pending transaction %x: %v", tx.TxHash, err))
+		}
+	}
+	return chain, nil
+}
+
+// Save writes the chain and its pending transactions to path, replacing the previous copy atomically.
+func (c *Chain) Save(path string) error {
+	c.Mutex.Lock()
+	data, err := json.Marshal(ChainState{Blocks: c.BlockHistory, Pending: c.PendingTransactions})
+	c.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func (c *Chain) AddTransaction(tx Transaction) error {
 	err := tx.Validate()
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+	}
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	for _, pending := range c.PendingTransactions {
+		if pending.TxHash == tx.TxHash {
+			return errors.New("transaction is already pending")
+		}
 	}
 	c.PendingTransactions = append(c.PendingTransactions, tx)
 	return nil
 }
 
-func (c *Chain) MineBlock(miner PrivateKey) error {
+// MineBlock builds a block of our pending transactions with the highest fees, has our consensus seal it and adds it
+// to the chain. Sealing happens without holding the chain, since proof of work can take a while; it gives up once ctx is cancelled.
+func (c *Chain) MineBlock(ctx context.Context, miner PrivateKey) (*Block, error) {
+	c.Mutex.Lock()
+
 	// Check for transactions to mine
 	if len(c.PendingTransactions) == 0 {
-		return errors.New("no transactions to mine")
+		c.Mutex.Unlock()
+		return nil, errors.New("no transactions to mine")
 	}
 
 	// Max block size 1MB
@@ -68,34 +190,211 @@ func (c *Chain) MineBlock(miner PrivateKey) error {
 	edPublicKey := ed25519.PublicKey(miner[32:])
 	publicKey, err := ToPublicKey(edPublicKey)
 	if err != nil {
-		return err
+		c.Mutex.Unlock()
+		return nil, err
 	}
 
 	// Create a new block
 	block := Block{
 		Height:       uint64(len(c.BlockHistory) + 1),
+		ParentHash:   c.tipHash(),
+		Version:      BlockVersionMerkle,
 		Timestamp:    time.Now(),
 		Issuer:       publicKey,
 		Transactions: blockTransactions,
 	}
+	block.StateRoot = StateRoot(c.nextState(&block))
+	err = c.Consensus.Prepare(c, &block)
+	c.Mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	// Sign the block
-	err = block.Sign(miner)
+	// Seal the block
+	err = c.Consensus.Seal(ctx, &block, miner)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Validate the block
-	err = block.Validate()
+	// Add the block to the chain, which also removes its transactions from the pool
+	err = c.AddBlock(block)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Add the block to the chain
-	c.BlockHistory = append(c.BlockHistory, block)
+	return &block, nil
+}
 
-	// Remove mined transactions from the pool
-	c.PendingTransactions = c.PendingTransactions[len(blockTransactions):]
+// Height returns the height of our best block, or 0 for an empty chain.
+func (c *Chain) Height() uint64 {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
 
-	return nil
+	return uint64(len(c.BlockHistory))
+}
+
+// Tip returns the height and hash of our best block.
+func (c *Chain) Tip() (uint64, Hash) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return uint64(len(c.BlockHistory)), c.tipHash()
+}
+
+// HasBlock reports whether the block at height on our chain has hash.
+func (c *Chain) HasBlock(height uint64, hash Hash) bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return height >= 1 && height <= uint64(len(c.BlockHistory)) && c.BlockHistory[height-1].BlockHash == hash
+}
+
+// Header returns the header of our block at height.
+func (c *Chain) Header(height uint64) (BlockHeader, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if height < 1 || height > uint64(len(c.BlockHistory)) {
+		return BlockHeader{}, false
+	}
+	return c.BlockHistory[height-1].Header(), true
+}
+
+// BlockByHash returns the block with hash, on our chain or on a side chain.
+func (c *Chain) BlockByHash(hash Hash) (Block, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if i := c.indexOfLocked(hash); i >= 0 {
+		return c.BlockHistory[i], true
+	}
+	block, exists := c.Side[hash]
+	return block, exists
+}
+
+// Pending returns a copy of the pending transaction pool.
+func (c *Chain) Pending() []Transaction {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return append([]Transaction(nil), c.PendingTransactions...)
+}
+
+// PendingTransaction returns the pending transaction with hash.
+func (c *Chain) PendingTransaction(hash Hash) (Transaction, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	for _, tx := range c.PendingTransactions {
+		if tx.TxHash == hash {
+			return tx, true
+		}
+	}
+	return Transaction{}, false
+}
+
+// Locator returns hashes of our chain for a peer to find the last block we have in common.
+// It lists the ten most recent blocks and then steps back exponentially, always ending with the first block.
+func (c *Chain) Locator() []Hash {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return buildLocator(len(c.BlockHistory), func(i int) Hash { return c.BlockHistory[i].BlockHash })
+}
+
+// buildLocator returns the locator of a chain of count blocks, where hashAt returns the hash of the block at index i.
+func buildLocator(count int, hashAt func(i int) Hash) []Hash {
+	locator := make([]Hash, 0, 32)
+	step := 1
+	for i := count - 1; i >= 0; i -= step {
+		locator = append(locator, hashAt(i))
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		if i > 0 && i-step < 0 {
+			locator = append(locator, hashAt(0))
+			break
+		}
+	}
+	return locator
+}
+
+// BlocksAfter returns the blocks that follow the last locator block we have, stopping after stop or once
+// the blocks add up to about maxBytes. At least one block is returned if there are any.
+func (c *Chain) BlocksAfter(locator []Hash, stop Hash, maxBytes int) []Block {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	blocks := make([]Block, 0)
+	size := 0
+	for i := c.forkIndex(locator); i < len(c.BlockHistory); i++ {
+		block := c.BlockHistory[i]
+		encoded, err := json.Marshal(block)
+		if err != nil {
+			break
+		}
+		if size += len(encoded); size > maxBytes && len(blocks) > 0 {
+			break
+		}
+		blocks = append(blocks, block)
+		if block.BlockHash == stop {
+			break
+		}
+	}
+	return blocks
+}
+
+// HeadersAfter returns up to max headers that follow the last locator block we have, stopping after stop.
+func (c *Chain) HeadersAfter(locator []Hash, stop Hash, max int) []BlockHeader {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	headers := make([]BlockHeader, 0)
+	for i := c.forkIndex(locator); i < len(c.BlockHistory) && len(headers) < max; i++ {
+		headers = append(headers, c.BlockHistory[i].Header())
+		if c.BlockHistory[i].BlockHash == stop {
+			break
+		}
+	}
+	return headers
+}
+
+// forkIndex returns the index of the first block after the newest locator hash on our chain,
+// or 0 if we have none of them. The caller must hold c.Mutex.
+func (c *Chain) forkIndex(locator []Hash) int {
+	index := make(map[Hash]int, len(c.BlockHistory))
+	for i, block := range c.BlockHistory {
+		index[block.BlockHash] = i
+	}
+	for _, hash := range locator {
+		if i, exists := index[hash]; exists {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// tipHash returns the hash of the most recent block, or the zero hash for an empty chain.
+// The caller must hold c.Mutex.
+func (c *Chain) tipHash() Hash {
+	if len(c.BlockHistory) == 0 {
+		return Hash{}
+	}
+	return c.BlockHistory[len(c.BlockHistory)-1].BlockHash
+}
+
+// removePending drops txs from the pending pool. The caller must hold c.Mutex.
+func (c *Chain) removePending(txs []Transaction) {
+	confirmed := make(map[Hash]bool, len(txs))
+	for _, tx := range txs {
+		confirmed[tx.TxHash] = true
+	}
+
+	remaining := c.PendingTransactions[:0]
+	for _, tx := range c.PendingTransactions {
+		if !confirmed[tx.TxHash] {
+			remaining = append(remaining, tx)
+		}
+	}
+	c.PendingTransactions = remaining
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// NewCompactBlock describes block by its header and the short IDs of its transactions.
+func NewCompactBlock(block *Block) *CompactBlock {
+	header := block.Header()
+	header.TxHashes = nil
+
+	var salt [8]byte
+	rand.Read(salt[:])
+	compact := &CompactBlock{
+		Header:   header,
+		Salt:     binary.LittleEndian.Uint64(salt[:]),
+		ShortIDs: make([]uint64, len(block.Transactions)),
+	}
+	for i, tx := range block.Transactions {
+		compact.ShortIDs[i] = compact.ShortID(tx.Hash())
+	}
+	return compact
+}
+
+// ShortID returns the short ID of the transaction with txHash in this compact block.
+func (cb *CompactBlock) ShortID(txHash Hash) uint64 {
+	h := sha256.New()
+	h.Write(cb.Header.BlockHash[:])
+	binary.Write(h, binary.LittleEndian, cb.Salt)
+	h.Write(txHash[:])
+	return binary.LittleEndian.Uint64(h.Sum(nil)) & ShortIDMask
+}
+
+// checkHeader checks what a compact block's header shows on its own: the issuer's signature and, from
+// BlockVersionMerkle on, the hash. Older hashes cover the transaction hashes, which the header leaves out.
+func (cb *CompactBlock) checkHeader() error {
+	if cb.Header.Version >= BlockVersionMerkle {
+		return cb.Header.Validate()
+	}
+	if !ed25519.Verify(ed25519.PublicKey(cb.Header.Issuer[:]), cb.Header.BlockHash[:], cb.Header.Signature[:]) {
+		return errors.New("block signature is invalid")
+	}
+	return nil
+}
+
+// handleCompactBlock rebuilds an announced block in the background, since fetching missing
+// transactions needs a response from the peer that only the read loop can deliver.
+func (pm *PeerManager) handleCompactBlock(from *Peer, compact *CompactBlock) {
+	if compact == nil || len(compact.ShortIDs) == 0 {
+		pm.Misbehaving(from, OffenseMalformedMessage, "compact block without transactions")
+		return
+	}
+	if pm.Seen.Has(compact.Header.BlockHash) {
+		from.known.Add(compact.Header.BlockHash)
+		return
+	}
+	if err := compact.checkHeader(); err != nil {
+		pm.Misbehaving(from, OffenseInvalidBlock, err.Error())
+		return
+	}
+	from.known.Add(compact.Header.BlockHash)
+
+	// A header that commits to the whole block can't be forged once it checks out, so copies from
+	// other peers needn't be rebuilt too. An older block is only marked seen once it is accepted.
+	if compact.Header.Version >= BlockVersionMerkle && !pm.Seen.Add(compact.Header.BlockHash) {
+		return
+	}
+
+	// A light client only needs the header, which can be checked on its own if it commits to a TxRoot
+	if pm.Light != nil {
+		if compact.Header.Version >= BlockVersionMerkle {
+			pm.acceptHeader(from, &compact.Header)
+		} else {
+			from.setHeight(compact.Header.Height)
+			pm.requestSync(from)
+		}
+		return
+	}
+
+	// Only a block that extends our tip, or a side chain we hold, can be rebuilt from our pending pool
+	if height := pm.Chain.Height(); compact.Header.Height != height+1 && !(pm.Chain.AllowsForks() && pm.Chain.Knows(compact.Header.ParentHash)) {
+		if compact.Header.Height > height {
+			from.setHeight(compact.Header.Height)
+			pm.requestSync(from)
+		}
+		return
+	}
+
+	go pm.completeCompactBlock(from, compact)
+}
+
+// completeCompactBlock rebuilds a compact block from our pending pool, asks the peer for any
+// transactions we don't have and adds the block. If the short IDs led us to the wrong
+// transactions we fall back to fetching the whole block.
+func (pm *PeerManager) completeCompactBlock(from *Peer, compact *CompactBlock) {
+	block, err := pm.rebuildCompactBlock(from, compact)
+	if err != nil {
+		Log(DEBUG, fmt.Sprintf("failed to rebuild compact block %x from peer %s, fetching it in full: %v", compact.Header.BlockHash, from.NodeID, err))
+		pm.countCompactBlock(&pm.Metrics.CompactBlockFailures)
+
+		blocks, err := from.SendGetBlocks(&GetBlocksRequest{
+			Locator: []Hash{compact.Header.ParentHash},
+			Stop:    compact.Header.BlockHash,
+		})
+		if err != nil || len(blocks) == 0 || blocks[0].BlockHash != compact.Header.BlockHash {
+			Log(WARNING, fmt.Sprintf("failed to fetch block %x from peer %s: %v", compact.Header.BlockHash, from.NodeID, err))
+			return
+		}
+		block = &blocks[0]
+	}
+
+	pm.acceptBlock(from, block)
+}
+
+// rebuildCompactBlock fills in a compact block's transactions from our pending pool and the peer.
+func (pm *PeerManager) rebuildCompactBlock(from *Peer, compact *CompactBlock) (*Block, error) {
+	// Index our pending pool by short ID, leaving out IDs that more than one transaction shares
+	pool := make(map[uint64]*Transaction)
+	collisions := make(map[uint64]bool)
+	pending := pm.Chain.Pending()
+	for i := range pending {
+		id := compact.ShortID(pending[i].TxHash)
+		if _, exists := pool[id]; exists {
+			collisions[id] = true
+		}
+		pool[id] = &pending[i]
+	}
+
+	txs := make([]Transaction, len(compact.ShortIDs))
+	missing := make([]int, 0)
+	for i, id := range compact.ShortIDs {
+		if tx, exists := pool[id]; exists && !collisions[id] {
+			txs[i] = *tx
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) > 0 {
+		fetched, err := from.SendGetBlockTxs(&GetBlockTxsRequest{BlockHash: compact.Header.BlockHash, Indexes: missing})
+		if err != nil {
+			return nil, err
+		}
+		if len(fetched) != len(missing) {
+			return nil, fmt.Errorf("asked for %d transactions, got %d", len(missing), len(fetched))
+		}
+		for i, index := range missing {
+			if compact.ShortID(fetched[i].Hash()) != compact.ShortIDs[index] {
+				return nil, errors.New("peer sent a transaction that does not match its short ID")
+			}
+			txs[index] = fetched[i]
+		}
+		pm.countCompactBlock(&pm.Metrics.CompactBlockFetches)
+	} else {
+		pm.countCompactBlock(&pm.Metrics.CompactBlocks)
+	}
+
+	header := compact.Header
+	block := &Block{
+		Height:       header.Height,
+		Nonce:        header.Nonce,
+		BlockHash:    header.BlockHash,
+		ParentHash:   header.ParentHash,
+		Version:      header.Version,
+		Timestamp:    header.Timestamp,
+		Issuer:       header.Issuer,
+		Signature:    header.Signature,
+		StateRoot:    header.StateRoot,
+		Target:       header.Target,
+		Vote:         header.Vote,
+		Transactions: txs,
+	}
+	if block.Hash() != header.BlockHash {
+		return nil, errors.New("rebuilt block does not match its hash")
+	}
+	return block, nil
+}
+
+// handleGetBlockTxs answers with the requested transactions of a block we relayed. For a block we don't hold
+// the answer is empty, so that the peer falls back to fetching the whole block at once rather than timing out.
+func (pm *PeerManager) handleGetBlockTxs(p *Peer, message *Message) {
+	request := message.GetBlockTxs
+	if request == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetBlockTxs without a body")
+		return
+	}
+
+	var txs []Transaction
+	if block, exists := pm.Chain.BlockByHash(request.BlockHash); exists {
+		txs = make([]Transaction, 0, len(request.Indexes))
+		for _, index := range request.Indexes {
+			if index < 0 || index >= len(block.Transactions) {
+				pm.Misbehaving(p, OffenseMalformedMessage, fmt.Sprintf("GetBlockTxs index %d out of range", index))
+				return
+			}
+			txs = append(txs, block.Transactions[index])
+		}
+	} else {
+		Log(DEBUG, fmt.Sprintf("peer %s asked for transactions of unknown block %x", p.NodeID, request.BlockHash))
+	}
+
+	response := &Message{Type: MessageTypeBlockTxs, BlockTxs: txs}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send block transactions to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// SendGetBlockTxs asks the peer for some of the transactions of a compact block.
+func (p *Peer) SendGetBlockTxs(request *GetBlockTxsRequest) ([]Transaction, error) {
+	response, err := p.Request(&Message{Type: MessageTypeGetBlockTxs, GetBlockTxs: request})
+	if err != nil {
+		return nil, err
+	}
+	if response.Type != MessageTypeBlockTxs {
+		return nil, fmt.Errorf("unexpected message type received: %v", response.Type)
+	}
+	return response.BlockTxs, nil
+}
+
+// countCompactBlock increments one of the compact block counters.
+func (pm *PeerManager) countCompactBlock(counter *uint64) {
+	pm.Metrics.Mutex.Lock()
+	*counter++
+	pm.Metrics.Mutex.Unlock()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfigFile applies settings from a config file. Each line holds "name: value" where name is
+// any command line flag, and list flags such as bootstrap may be repeated. Blank lines and lines
+// starting with # are ignored. Flags given on the command line take precedence over the file.
+func loadConfigFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Remember which flags were set explicitly so the file doesn't override them
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return fmt.Errorf("%s:%d: expected \"name: value\"", path, lineNumber)
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+
+		if name == "config" {
+			return fmt.Errorf("%s:%d: config files cannot include other config files", path, lineNumber)
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, lineNumber, name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadSeedsFile reads bootstrap peers from a file with one host:port per line.
+// Blank lines and lines starting with # are ignored.
+func loadSeedsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var seeds []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers, err := parsePeerList(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		seeds = append(seeds, peers...)
+	}
+	return seeds, scanner.Err()
+}
+
+// parsePeerList splits a comma separated list of host:port addresses and checks each one.
+func parsePeerList(s string) ([]string, error) {
+	var peers []string
+	for _, address := range strings.Split(s, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, _, err := splitPeerAddress(address); err != nil {
+			return nil, err
+		}
+		peers = append(peers, address)
+	}
+	return peers, nil
+}
+
+// splitPeerAddress splits host:port into its parts, checking that the port is valid.
+func splitPeerAddress(address string) (string, uint16, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid peer address %q: %w", address, err)
+	}
+	peerPort, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || peerPort == 0 {
+		return "", 0, fmt.Errorf("invalid port in peer address %q", address)
+	}
+	return host, uint16(peerPort), nil
+}
+
+// ResolvePeerAddress turns a host:port address into an IP and port we can dial. Host names are looked up in DNS.
+func ResolvePeerAddress(address string) (net.IP, uint16, error) {
+	host, peerPort, err := splitPeerAddress(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, peerPort, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no addresses found for %s", host)
+	}
+	return ips[0], peerPort, nil
+}
+
+// parseExternalAddress turns a host or host:port address into the IP and port we advertise.
+// The port is 0 if the address doesn't give one.
+func parseExternalAddress(address string) (net.IP, uint16, error) {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return ResolvePeerAddress(address)
+	}
+	ip, _, err := ResolvePeerAddress(net.JoinHostPort(address, "1"))
+	return ip, 0, err
+}
+
+// parseMessageType looks up a message type by the name MessageType.String gives it.
+func parseMessageType(name string) (MessageType, error) {
+	for messageType, typeName := range messageTypeNames {
+		if typeName == name {
+			return messageType, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown message type %q", name)
+}
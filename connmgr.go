@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"net"
+	"time"
+)
+
+var (
+	ErrSelfConnection = errors.New("connected to ourselves")
+	ErrDuplicatePeer  = errors.New("already connected to this peer")
+	ErrInboundFull    = errors.New("no inbound slots available")
+	ErrTooManyFromIP  = errors.New("too many connections from this IP")
+	ErrTooManyFromNet = errors.New("too many connections from this network")
+)
+
+// reserveInbound takes an inbound slot for a connection from ip until the returned function is called,
+// so that connections still in their handshake count towards our caps. Loopback connections are only
+// held to maxInbound, since several local nodes connecting to each other is not an attack.
+func (pm *PeerManager) reserveInbound(ip net.IP) (func(), error) {
+	key := ip.String()
+	group := string(NetworkGroup(ip))
+
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+
+	total := 0
+	for _, count := range pm.FromIP {
+		total += count
+	}
+	switch {
+	case total >= maxInbound:
+		return nil, ErrInboundFull
+	case !ip.IsLoopback() && pm.FromIP[key] >= maxPerIP:
+		return nil, ErrTooManyFromIP
+	case !ip.IsLoopback() && pm.FromNet[group] >= maxPerSubnet:
+		return nil, ErrTooManyFromNet
+	}
+	pm.FromIP[key]++
+	pm.FromNet[group]++
+
+	release := func() {
+		pm.Mutex.Lock()
+		defer pm.Mutex.Unlock()
+
+		if pm.FromIP[key]--; pm.FromIP[key] <= 0 {
+			delete(pm.FromIP, key)
+		}
+		if pm.FromNet[group]--; pm.FromNet[group] <= 0 {
+			delete(pm.FromNet, group)
+		}
+	}
+	return release, nil
+}
+
+// admitPeer adds a peer that has completed the hello handshake to our active peers.
+// When two nodes dial each other at the same time both ends keep the connection that
+// was dialed by the node with the lower NodeID, so they agree on which one to close.
+func (pm *PeerManager) admitPeer(p *Peer) error {
+	if p.NodeID == pm.MyNode.NodeID {
+		return ErrSelfConnection
+	}
+
+	p.Connected = time.Now()
+	err := pm.Peers.Add(p, func(existing *Peer, inbound, outbound int) error {
+		if pm.Context.Err() != nil {
+			return ErrShuttingDown
+		}
+		if existing != nil {
+			if !pm.preferConnection(p, existing) {
+				return ErrDuplicatePeer
+			}
+			Log(DEBUG, fmt.Sprintf("replacing duplicate connection to peer %s", p.NodeID))
+			existing.Close()
+			return nil
+		}
+		if p.Inbound && inbound >= maxInbound {
+			return ErrInboundFull
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	go pm.watchPeer(p)
+	go pm.keepAlive(p)
+	go pm.announceInventory(p)
+	go pm.requestMempool(p)
+	return nil
+}
+
+// preferConnection reports whether candidate should replace existing as our connection to the same peer.
+func (pm *PeerManager) preferConnection(candidate, existing *Peer) bool {
+	if candidate.Inbound == existing.Inbound {
+		return false
+	}
+	return pm.dialer(candidate) < pm.dialer(existing)
+}
+
+// dialer returns the NodeID of the node that opened the connection to p.
+func (pm *PeerManager) dialer(p *Peer) NodeID {
+	if p.Inbound {
+		return p.NodeID
+	}
+	return pm.MyNode.NodeID
+}
+
+// watchPeer removes p from our active peers once its connection closes, unless it has already been replaced.
+func (pm *PeerManager) watchPeer(p *Peer) {
+	<-p.Done()
+
+	if pm.Peers.Remove(p) {
+		Log(DEBUG, fmt.Sprintf("peer %s disconnected", p.NodeID))
+	}
+}
+
+// freeOutboundSlots returns how many more outbound connections we should open.
+func (pm *PeerManager) freeOutboundSlots() int {
+	_, outbound := pm.Peers.Counts()
+
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+
+	return maxOutbound - outbound - len(pm.Dialing)
+}
+
+// skipCandidate reports whether an address book entry is banned or we are already connected or connecting to it.
+func (pm *PeerManager) skipCandidate(entry *AddressEntry) bool {
+	if pm.Bans.IsBanned(entry.Address) {
+		return true
+	}
+
+	key := AddressKey(entry.Address, entry.Port)
+	pm.Mutex.Lock()
+	dialing := pm.Dialing[key]
+	pm.Mutex.Unlock()
+
+	if dialing {
+		return true
+	}
+	for _, peer := range pm.Peers.List() {
+		if AddressKey(peer.Address, peer.Port) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundCandidates returns up to n address book entries to dial, best first. It takes at most one
+// entry per network group and none from a group we already have an outbound peer in, so that an
+// attacker holding a single subnet can't become all of our outbound peers.
+func (pm *PeerManager) outboundCandidates(n int) []AddressEntry {
+	if n <= 0 {
+		return nil
+	}
+
+	used := make(map[string]bool)
+	for _, peer := range pm.Peers.List() {
+		if !peer.Inbound {
+			used[diversityGroup(peer.Address)] = true
+		}
+	}
+	pm.Mutex.Lock()
+	for key := range pm.Dialing {
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			used[diversityGroup(net.ParseIP(host))] = true
+		}
+	}
+	pm.Mutex.Unlock()
+
+	candidates := make([]AddressEntry, 0, n)
+	for _, entry := range pm.Book.Candidates(math.MaxInt, pm.skipCandidate) {
+		group := diversityGroup(entry.Address)
+		if group != "" && used[group] {
+			continue
+		}
+		used[group] = true
+		candidates = append(candidates, entry)
+		if len(candidates) == n {
+			break
+		}
+	}
+	return candidates
+}
+
+// diversityGroup returns the network group we spread outbound peers across, or "" for loopback
+// addresses, which can't belong to an attacker and so needn't be spread.
+func diversityGroup(ip net.IP) string {
+	if ip == nil || ip.IsLoopback() {
+		return ""
+	}
+	return string(NetworkGroup(ip))
+}
+
+// RunConnectionManager keeps our outbound slots filled from the address book for as long as we run.
+// Slots are topped up as soon as an outbound peer disconnects, and every ConnectionCheckInterval otherwise.
+func (pm *PeerManager) RunConnectionManager() {
+	events, unsubscribe := pm.Peers.Subscribe()
+	defer unsubscribe()
+
+	for {
+		pm.fillOutboundSlots()
+
+		timer := time.NewTimer(jitter(ConnectionCheckInterval))
+	wait:
+		for {
+			select {
+			case <-pm.Context.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				break wait
+			case event := <-events:
+				if event.Type == PeerDisconnected && !event.Peer.Inbound {
+					timer.Stop()
+					break wait
+				}
+			}
+		}
+	}
+}
+
+// fillOutboundSlots dials the best address book candidates for any free outbound slots.
+// If the address book has nothing left to offer we look for more on the discovery network
+// and ask our peers, or bootstrap if we have none.
+func (pm *PeerManager) fillOutboundSlots() {
+	missing := pm.freeOutboundSlots()
+	if missing <= 0 {
+		return
+	}
+
+	candidates := pm.outboundCandidates(missing)
+	if len(candidates) == 0 && pm.DHT != nil {
+		pm.Lookup(randomNodeID())
+		candidates = pm.outboundCandidates(missing)
+	}
+	if len(candidates) == 0 {
+		if pm.PeerCount() == 0 {
+			pm.Bootstrap()
+		} else {
+			pm.DiscoverPeers()
+		}
+		return
+	}
+
+	for _, candidate := range candidates {
+		// The slot is taken before the delay, or the next round would hand it out a second time
+		key := AddressKey(candidate.Address, candidate.Port)
+		if !pm.reserveDial(key) {
+			continue
+		}
+		entry := candidate
+		pm.startWorker(func() {
+			defer pm.releaseDial(key)
+
+			// Spread our dials out so that peers restarting together don't redial in lockstep
+			timer := time.NewTimer(time.Duration(mrand.Int63n(int64(DialJitter))))
+			defer timer.Stop()
+			select {
+			case <-pm.Context.Done():
+				return
+			case <-timer.C:
+			}
+			if _, err := pm.connectToReserved(entry.Address, entry.Port); err != nil {
+				Log(DEBUG, fmt.Sprintf("failed to connect to %s: %v", key, err))
+			}
+		})
+	}
+}
+
+// jitter returns a random duration between half and one and a half times d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(mrand.Int63n(int64(d)))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// NewDandelionState creates an empty stem pool. Destinations are chosen once we have a transaction to stem.
+func NewDandelionState() *DandelionState {
+	return &DandelionState{
+		Mutex:  new(sync.Mutex),
+		Pool:   make(map[Hash]*StemTransaction),
+		Routes: make(map[*Peer]*Peer),
+	}
+}
+
+// take removes the transaction with hash from the stem pool and returns it, if it was there.
+func (s *DandelionState) take(hash Hash) (Transaction, bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	stem, exists := s.Pool[hash]
+	if !exists {
+		return Transaction{}, false
+	}
+	delete(s.Pool, hash)
+	return stem.Transaction, true
+}
+
+// expired removes and returns the stem transactions whose embargo has passed.
+func (s *DandelionState) expired(now time.Time) []Transaction {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	txs := make([]Transaction, 0)
+	for hash, stem := range s.Pool {
+		if now.After(stem.Embargo) {
+			txs = append(txs, stem.Transaction)
+			delete(s.Pool, hash)
+		}
+	}
+	return txs
+}
+
+// handleStemTransaction passes a stem transaction on to the next peer of its stem, or ends the stem and fluffs it.
+// Until it is fluffed the transaction stays out of our pending pool, so we never reveal it to anyone but the next hop.
+func (pm *PeerManager) handleStemTransaction(from *Peer, tx *Transaction) {
+	if tx == nil {
+		pm.Misbehaving(from, OffenseMalformedMessage, "stem transaction message without a transaction")
+		return
+	}
+	if pm.Seen.Has(tx.TxHash) {
+		return
+	}
+	if err := tx.Validate(); err != nil {
+		pm.Misbehaving(from, OffenseInvalidTransaction, err.Error())
+		return
+	}
+
+	if mrand.Float64() < FluffProbability {
+		Log(DEBUG, fmt.Sprintf("ending the stem of transaction %x from peer %s", tx.TxHash, from.NodeID))
+		pm.fluff(tx)
+		return
+	}
+	pm.stem(from, tx)
+}
+
+// stem passes tx on to the destination we route stem transactions from from to, and starts its embargo timer.
+// from is nil for our own transactions. Without a destination the transaction is fluffed straight away.
+func (pm *PeerManager) stem(from *Peer, tx *Transaction) {
+	s := pm.Stem
+	s.Mutex.Lock()
+	if _, exists := s.Pool[tx.TxHash]; exists {
+		s.Mutex.Unlock()
+		return
+	}
+	to := pm.stemRouteLocked(from)
+	if to == nil || len(s.Pool) >= MaxStemPool {
+		s.Mutex.Unlock()
+		pm.fluff(tx)
+		return
+	}
+	embargo := EmbargoTimeout + time.Duration(mrand.Int63n(int64(EmbargoJitter)))
+	s.Pool[tx.TxHash] = &StemTransaction{Transaction: *tx, Embargo: time.Now().Add(embargo)}
+	s.Mutex.Unlock()
+
+	// If the send fails the embargo fluffs the transaction for us
+	if err := to.sendMessage(&Message{Type: MessageTypeStemTransaction, Transaction: tx}); err != nil {
+		Log(DEBUG, fmt.Sprintf("Failed to stem transaction to peer %s: %v", to.NodeID, err))
+	}
+}
+
+// stemRouteLocked returns the destination for stem transactions from from, choosing new destinations when the
+// epoch is over or one has disconnected. Every peer keeps the same route for the whole epoch, so a spy sending
+// us several transactions learns no more than one would. The caller must hold pm.Stem.Mutex.
+func (pm *PeerManager) stemRouteLocked(from *Peer) *Peer {
+	s := pm.Stem
+	if time.Since(s.Epoch) > DandelionEpoch {
+		s.Destinations = nil
+		s.Routes = make(map[*Peer]*Peer)
+		s.Epoch = time.Now()
+	}
+
+	live := make([]*Peer, 0, DandelionDestinations)
+	for _, peer := range s.Destinations {
+		if pm.Peers.Get(peer.NodeID) == peer {
+			live = append(live, peer)
+		}
+	}
+	if len(live) < DandelionDestinations {
+		candidates := make([]*Peer, 0)
+		for _, peer := range pm.Peers.List() {
+			if !peer.Inbound && !containsPeer(live, peer) {
+				candidates = append(candidates, peer)
+			}
+		}
+		mrand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		for _, peer := range candidates {
+			if len(live) == DandelionDestinations {
+				break
+			}
+			live = append(live, peer)
+		}
+	}
+	s.Destinations = live
+
+	if route, exists := s.Routes[from]; exists && containsPeer(live, route) {
+		return route
+	}
+
+	// A stem never goes straight back to the peer it came from
+	choices := make([]*Peer, 0, len(live))
+	for _, peer := range live {
+		if peer != from {
+			choices = append(choices, peer)
+		}
+	}
+	if len(choices) == 0 {
+		return nil
+	}
+	route := choices[mrand.Intn(len(choices))]
+	s.Routes[from] = route
+	return route
+}
+
+// fluff adds tx to our pending pool and announces it to every peer, ending its stem phase.
+func (pm *PeerManager) fluff(tx *Transaction) {
+	pm.Stem.take(tx.TxHash)
+	pm.Seen.Add(tx.TxHash)
+	if _, pending := pm.Chain.PendingTransaction(tx.TxHash); !pending {
+		if err := pm.Chain.AddTransaction(*tx); err != nil {
+			Log(WARNING, fmt.Sprintf("Failed to fluff transaction %x: %v", tx.TxHash, err))
+			return
+		}
+	}
+	pm.announce(tx.TxHash)
+}
+
+// RunDandelion fluffs the stem transactions whose embargo passed without us seeing them fluffed,
+// in case a node on their stem dropped them. It returns once we shut down.
+func (pm *PeerManager) RunDandelion() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.Context.Done():
+			return
+		case now := <-ticker.C:
+			for _, tx := range pm.Stem.expired(now) {
+				Log(INFO, fmt.Sprintf("embargo expired for stem transaction %x, fluffing it", tx.TxHash))
+				tx := tx
+				pm.fluff(&tx)
+			}
+		}
+	}
+}
+
+// containsPeer reports whether peers holds p.
+func containsPeer(peers []*Peer, p *Peer) bool {
+	for _, peer := range peers {
+		if peer == p {
+			return true
+		}
+	}
+	return false
+}
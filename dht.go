@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dhtWaiter is a request waiting for its reply from addr.
+type dhtWaiter struct {
+	addr  string
+	reply chan *DHTPacket
+}
+
+func (t DHTPacketType) String() string {
+	switch t {
+	case DHTPing:
+		return "ping"
+	case DHTPong:
+		return "pong"
+	case DHTFindNode:
+		return "findnode"
+	case DHTNeighbors:
+		return "neighbors"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// NewDHTState creates an empty routing table for self, served over conn.
+func NewDHTState(self NodeID, conn net.PacketConn) *DHTState {
+	return &DHTState{
+		Mutex:    new(sync.Mutex),
+		Conn:     conn,
+		Self:     self,
+		pending:  make(map[uint64]dhtWaiter),
+		checking: make(map[NodeID]bool),
+	}
+}
+
+func (p *DHTPacket) Hash() Hash {
+	h := sha256.New()
+
+	// Add packet fields to hash, length prefixing the variable sized ones
+	binary.Write(h, binary.LittleEndian, int64(p.Type))
+	binary.Write(h, binary.LittleEndian, p.RequestID)
+	binary.Write(h, binary.LittleEndian, p.ResponseTo)
+	fromHash := p.From.Hash()
+	h.Write(fromHash[:])
+	h.Write(p.YourAddress.To16())
+	binary.Write(h, binary.LittleEndian, uint16(len(p.Target)))
+	h.Write([]byte(p.Target))
+	binary.Write(h, binary.LittleEndian, uint16(len(p.Nodes)))
+	for _, node := range p.Nodes {
+		recordHash := node.Record.Hash()
+		h.Write(recordHash[:])
+		binary.Write(h, binary.LittleEndian, uint16(len(node.Endpoint)))
+		h.Write([]byte(node.Endpoint))
+	}
+
+	return Hash(sha256.Sum256(h.Sum(nil)))
+}
+
+func (p *DHTPacket) Sign(key PrivateKey) error {
+	packetHash := p.Hash()
+
+	signature := ed25519.Sign(ed25519.PrivateKey(key[:]), packetHash[:])
+	if len(signature) != len(p.Signature) {
+		return errors.New("signature generation failed")
+	}
+
+	copy(p.Signature[:], signature)
+	return nil
+}
+
+// Validate checks that the packet was signed by the node its record describes.
+func (p *DHTPacket) Validate() error {
+	if err := p.From.Validate(); err != nil {
+		return err
+	}
+
+	packetHash := p.Hash()
+	if !ed25519.Verify(ed25519.PublicKey(p.From.PublicKey[:]), packetHash[:], p.Signature[:]) {
+		return errors.New("packet signature is invalid")
+	}
+	return nil
+}
+
+// nodeIDBytes decodes a NodeID into the bits distances are measured on.
+func nodeIDBytes(id NodeID) ([16]byte, error) {
+	var b [16]byte
+	decoded, err := hex.DecodeString(string(id))
+	if err != nil || len(decoded) != len(b) {
+		return b, fmt.Errorf("malformed NodeID %q", id)
+	}
+	copy(b[:], decoded)
+	return b, nil
+}
+
+// dhtDistance returns the XOR distance between two NodeIDs. Malformed NodeIDs are as far away as possible.
+func dhtDistance(a, b NodeID) [16]byte {
+	var distance [16]byte
+	aBytes, errA := nodeIDBytes(a)
+	bBytes, errB := nodeIDBytes(b)
+	for i := range distance {
+		if errA != nil || errB != nil {
+			distance[i] = 0xff
+			continue
+		}
+		distance[i] = aBytes[i] ^ bBytes[i]
+	}
+	return distance
+}
+
+// bucketIndex returns the bucket id belongs in relative to self, or -1 if it is self.
+func bucketIndex(self, id NodeID) int {
+	distance := dhtDistance(self, id)
+	for i, b := range distance {
+		if b != 0 {
+			return (len(distance)-i-1)*8 + bits.Len8(b) - 1
+		}
+	}
+	return -1
+}
+
+// randomNodeIDInBucket returns a random NodeID that falls in bucket relative to self.
+func randomNodeIDInBucket(self NodeID, bucket int) NodeID {
+	id, err := nodeIDBytes(self)
+	if err != nil {
+		return self
+	}
+	var random [16]byte
+	rand.Read(random[:])
+
+	// Keep the bits above the bucket, flip the bucket's bit and randomize the rest
+	byteIndex := len(id) - 1 - bucket/8
+	bit := byte(1) << (bucket % 8)
+	id[byteIndex] ^= bit
+	id[byteIndex] = id[byteIndex]&^(bit-1) | random[byteIndex]&(bit-1)
+	copy(id[byteIndex+1:], random[byteIndex+1:])
+	return NodeID(hex.EncodeToString(id[:]))
+}
+
+// randomNodeID returns a random NodeID to look up.
+func randomNodeID() NodeID {
+	var id [16]byte
+	rand.Read(id[:])
+	return NodeID(hex.EncodeToString(id[:]))
+}
+
+// sortByDistance orders contacts closest to target first.
+func sortByDistance(contacts []DHTContact, target NodeID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		a := dhtDistance(contacts[i].Record.NodeID, target)
+		b := dhtDistance(contacts[j].Record.NodeID, target)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
+
+// seen records that we heard from node. If its bucket is full, the least recently seen node is returned so
+// the caller can check whether it is still alive, unless that check is already under way.
+func (d *DHTState) seen(node *DHTNode) *DHTNode {
+	index := bucketIndex(d.Self, node.Contact.Record.NodeID)
+	if index < 0 {
+		return nil
+	}
+
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	bucket := d.Buckets[index]
+	for i, existing := range bucket {
+		if existing.Contact.Record.NodeID == node.Contact.Record.NodeID {
+			// Move it to the most recently seen end
+			copy(bucket[i:], bucket[i+1:])
+			bucket[len(bucket)-1] = node
+			return nil
+		}
+	}
+	if len(bucket) < DHTBucketSize {
+		d.Buckets[index] = append(bucket, node)
+		return nil
+	}
+
+	oldest := bucket[0]
+	if d.checking[oldest.Contact.Record.NodeID] {
+		return nil
+	}
+	d.checking[oldest.Contact.Record.NodeID] = true
+	return oldest
+}
+
+// replace swaps oldest for newcomer once oldest has failed to answer. newcomer is dropped if oldest answered.
+func (d *DHTState) replace(oldest, newcomer *DHTNode, alive bool) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	delete(d.checking, oldest.Contact.Record.NodeID)
+	if alive {
+		return
+	}
+	index := bucketIndex(d.Self, oldest.Contact.Record.NodeID)
+	d.removeLocked(index, oldest.Contact.Record.NodeID)
+	if len(d.Buckets[index]) < DHTBucketSize {
+		d.Buckets[index] = append(d.Buckets[index], newcomer)
+	}
+}
+
+// remove drops nodeID from the routing table.
+func (d *DHTState) remove(nodeID NodeID) {
+	index := bucketIndex(d.Self, nodeID)
+	if index < 0 {
+		return
+	}
+
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	d.removeLocked(index, nodeID)
+}
+
+// removeLocked drops nodeID from bucket index. The caller must hold d.Mutex.
+func (d *DHTState) removeLocked(index int, nodeID NodeID) {
+	bucket := d.Buckets[index]
+	for i, node := range bucket {
+		if node.Contact.Record.NodeID == nodeID {
+			d.Buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to n of the nodes we know closest to target, leaving out exclude.
+func (d *DHTState) closest(target NodeID, n int, exclude NodeID) []DHTContact {
+	d.Mutex.Lock()
+	contacts := make([]DHTContact, 0)
+	for _, bucket := range d.Buckets {
+		for _, node := range bucket {
+			if node.Contact.Record.NodeID != exclude {
+				contacts = append(contacts, node.Contact)
+			}
+		}
+	}
+	d.Mutex.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Size returns how many nodes are in the routing table.
+func (d *DHTState) Size() int {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	size := 0
+	for _, bucket := range d.Buckets {
+		size += len(bucket)
+	}
+	return size
+}
+
+// markRefreshed records that a lookup for target just covered its bucket.
+func (d *DHTState) markRefreshed(target NodeID) {
+	index := bucketIndex(d.Self, target)
+	if index < 0 {
+		return
+	}
+
+	d.Mutex.Lock()
+	d.Refreshed[index] = time.Now()
+	d.Mutex.Unlock()
+}
+
+// maintenance returns the non-empty buckets that haven't been looked up for DHTBucketStale,
+// and the least recently seen node of every bucket, which should be checked for liveness.
+func (d *DHTState) maintenance() ([]int, []*DHTNode) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	stale := make([]int, 0)
+	oldest := make([]*DHTNode, 0)
+	now := time.Now()
+	for i, bucket := range d.Buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		if now.Sub(d.Refreshed[i]) > DHTBucketStale {
+			stale = append(stale, i)
+		}
+		oldest = append(oldest, bucket[0])
+	}
+	return stale, oldest
+}
+
+// StartDHT runs our UDP discovery service on address until we shut down.
+func (pm *PeerManager) StartDHT(address string, seeds []string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	pm.DHT = NewDHTState(pm.MyNode.NodeID, conn)
+	Log(INFO, fmt.Sprintf("peer discovery listening on udp %s", conn.LocalAddr()))
+
+	pm.startWorker(func() {
+		<-pm.Context.Done()
+		conn.Close()
+	})
+	pm.startWorker(pm.serveDHT)
+	pm.startWorker(func() { pm.RunDHT(seeds) })
+	return nil
+}
+
+// serveDHT reads discovery packets until we shut down.
+func (pm *PeerManager) serveDHT() {
+	buffer := make([]byte, MaxDHTPacketSize)
+	for {
+		n, addr, err := pm.DHT.Conn.ReadFrom(buffer)
+		if err != nil {
+			if pm.Context.Err() != nil {
+				return
+			}
+			Log(ERROR, fmt.Sprintf("Failed to read discovery packet: %v", err))
+			continue
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		var packet DHTPacket
+		if err := json.Unmarshal(buffer[:n], &packet); err != nil {
+			Log(DEBUG, fmt.Sprintf("dropping malformed discovery packet from %s: %v", from, err))
+			continue
+		}
+		pm.handleDHTPacket(&packet, from)
+	}
+}
+
+// handleDHTPacket answers requests and delivers replies. Every validly signed packet
+// also tells us its sender is alive, so the sender goes into our routing table.
+func (pm *PeerManager) handleDHTPacket(packet *DHTPacket, from *net.UDPAddr) {
+	if err := packet.Validate(); err != nil {
+		Log(DEBUG, fmt.Sprintf("dropping discovery packet from %s: %v", from, err))
+		return
+	}
+	if packet.From.NodeID == pm.MyNode.NodeID || pm.Bans.IsBanned(from.IP) {
+		return
+	}
+
+	pm.dhtSeen(&DHTNode{
+		Contact:  DHTContact{Record: packet.From, Endpoint: from.String()},
+		Addr:     from,
+		LastSeen: time.Now(),
+	})
+	pm.Book.Add(packet.From, from.IP)
+
+	switch packet.Type {
+	case DHTPing:
+		pm.sendDHT(&DHTPacket{Type: DHTPong, ResponseTo: packet.RequestID, YourAddress: from.IP}, from)
+	case DHTFindNode:
+		pm.sendDHT(&DHTPacket{
+			Type:        DHTNeighbors,
+			ResponseTo:  packet.RequestID,
+			YourAddress: from.IP,
+			Nodes:       pm.DHT.closest(packet.Target, DHTBucketSize, packet.From.NodeID),
+		}, from)
+	case DHTPong, DHTNeighbors:
+		pm.DHT.Mutex.Lock()
+		waiter, exists := pm.DHT.pending[packet.ResponseTo]
+		if exists && waiter.addr == from.String() {
+			delete(pm.DHT.pending, packet.ResponseTo)
+		} else {
+			exists = false
+		}
+		pm.DHT.Mutex.Unlock()
+
+		if !exists {
+			Log(DEBUG, fmt.Sprintf("dropping unexpected discovery %s from %s", packet.Type, from))
+			return
+		}
+		waiter.reply <- packet
+	default:
+		Log(DEBUG, fmt.Sprintf("dropping discovery packet of unknown type %v from %s", packet.Type, from))
+	}
+}
+
+// dhtSeen adds node to our routing table. If its bucket is full we ping the bucket's least recently
+// seen node and only let node in if that one doesn't answer, since long lived nodes are the most reliable.
+func (pm *PeerManager) dhtSeen(node *DHTNode) {
+	oldest := pm.DHT.seen(node)
+	if oldest == nil {
+		return
+	}
+
+	go func() {
+		_, err := pm.DHTPing(oldest.Addr)
+		pm.DHT.replace(oldest, node, err == nil)
+	}()
+}
+
+// sendDHT signs packet as coming from us and sends it to addr.
+func (pm *PeerManager) sendDHT(packet *DHTPacket, addr *net.UDPAddr) error {
+	record, err := pm.MyRecord()
+	if err != nil {
+		return err
+	}
+	packet.From = *record
+	if err := packet.Sign(pm.Keys.PrivateKey); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	_, err = pm.DHT.Conn.WriteTo(data, addr)
+	return err
+}
+
+// dhtRequest sends packet to addr and waits for a reply of type expected.
+func (pm *PeerManager) dhtRequest(packet *DHTPacket, addr *net.UDPAddr, expected DHTPacketType) (*DHTPacket, error) {
+	reply := make(chan *DHTPacket, 1)
+	pm.DHT.Mutex.Lock()
+	pm.DHT.nextRequestID++
+	packet.RequestID = pm.DHT.nextRequestID
+	pm.DHT.pending[packet.RequestID] = dhtWaiter{addr: addr.String(), reply: reply}
+	pm.DHT.Mutex.Unlock()
+
+	defer func() {
+		pm.DHT.Mutex.Lock()
+		delete(pm.DHT.pending, packet.RequestID)
+		pm.DHT.Mutex.Unlock()
+	}()
+
+	if err := pm.sendDHT(packet, addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(DHTRequestTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-reply:
+		if response.Type != expected {
+			return nil, fmt.Errorf("unexpected discovery reply %v from %s", response.Type, addr)
+		}
+		return response, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("discovery %v to %s timed out", packet.Type, addr)
+	case <-pm.Context.Done():
+		return nil, ErrShuttingDown
+	}
+}
+
+// DHTPing checks that the node at addr is alive and counts the address it saw us at towards our external address,
+// as the pong answers a request of ours to an address we chose.
+func (pm *PeerManager) DHTPing(addr *net.UDPAddr) (*DHTPacket, error) {
+	pong, err := pm.dhtRequest(&DHTPacket{Type: DHTPing}, addr, DHTPong)
+	if err != nil {
+		return nil, err
+	}
+	pm.VoteAddress(addr.IP, pong.YourAddress)
+	return pong, nil
+}
+
+// DHTFindNode asks the node at addr for the nodes it knows closest to target.
+// Records that check out go into our address book.
+func (pm *PeerManager) DHTFindNode(addr *net.UDPAddr, target NodeID) ([]DHTContact, error) {
+	neighbors, err := pm.dhtRequest(&DHTPacket{Type: DHTFindNode, Target: target}, addr, DHTNeighbors)
+	if err != nil {
+		return nil, err
+	}
+	pm.VoteAddress(addr.IP, neighbors.YourAddress)
+
+	contacts := make([]DHTContact, 0, len(neighbors.Nodes))
+	for _, contact := range neighbors.Nodes {
+		if err := contact.Record.Validate(); err != nil {
+			return nil, fmt.Errorf("node %s sent a bad record: %w", neighbors.From.NodeID, err)
+		}
+		if contact.Record.NodeID == pm.MyNode.NodeID {
+			continue
+		}
+		if time.Since(contact.Record.LastSeen) <= PeerRecordTTL {
+			pm.Book.Add(contact.Record, addr.IP)
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
+}
+
+// Lookup finds the DHTBucketSize nodes closest to target that answer us, by repeatedly asking the
+// closest nodes we know of for closer ones, DHTAlpha at a time, until none of them know any closer.
+func (pm *PeerManager) Lookup(target NodeID) []DHTContact {
+	pm.DHT.markRefreshed(target)
+
+	type result struct {
+		contact  DHTContact
+		contacts []DHTContact
+		err      error
+	}
+
+	closest := pm.DHT.closest(target, DHTBucketSize, "")
+	known := make(map[NodeID]bool)
+	for _, contact := range closest {
+		known[contact.Record.NodeID] = true
+	}
+	queried := make(map[NodeID]bool)
+	answered := make(map[NodeID]bool)
+
+	for pm.Context.Err() == nil {
+		batch := make([]DHTContact, 0, DHTAlpha)
+		for _, contact := range closest {
+			if len(batch) == DHTAlpha {
+				break
+			}
+			if !queried[contact.Record.NodeID] {
+				queried[contact.Record.NodeID] = true
+				batch = append(batch, contact)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, contact := range batch {
+			go func(contact DHTContact) {
+				addr, err := net.ResolveUDPAddr("udp", contact.Endpoint)
+				if err != nil {
+					results <- result{contact: contact, err: err}
+					return
+				}
+				contacts, err := pm.DHTFindNode(addr, target)
+				results <- result{contact: contact, contacts: contacts, err: err}
+			}(contact)
+		}
+
+		for range batch {
+			r := <-results
+			if r.err != nil {
+				Log(DEBUG, fmt.Sprintf("discovery lookup query to %s failed: %v", r.contact.Endpoint, r.err))
+				pm.DHT.remove(r.contact.Record.NodeID)
+				continue
+			}
+			answered[r.contact.Record.NodeID] = true
+			for _, contact := range r.contacts {
+				if !known[contact.Record.NodeID] {
+					known[contact.Record.NodeID] = true
+					closest = append(closest, contact)
+				}
+			}
+		}
+
+		// Forget the nodes that didn't answer and keep only the closest of the rest
+		alive := closest[:0]
+		for _, contact := range closest {
+			if !queried[contact.Record.NodeID] || answered[contact.Record.NodeID] {
+				alive = append(alive, contact)
+			}
+		}
+		closest = alive
+		sortByDistance(closest, target)
+		if len(closest) > DHTBucketSize {
+			closest = closest[:DHTBucketSize]
+		}
+	}
+	return closest
+}
+
+// RunDHT joins the discovery network through seeds and then keeps our routing table fresh until we shut down.
+func (pm *PeerManager) RunDHT(seeds []string) {
+	for pm.DHT.Size() == 0 {
+		pm.joinDHT(seeds)
+		if pm.DHT.Size() > 0 {
+			break
+		}
+
+		select {
+		case <-pm.Context.Done():
+			return
+		case <-time.After(DHTSeedRetry):
+		}
+	}
+
+	ticker := time.NewTicker(jitter(DHTRefreshInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pm.Context.Done():
+			return
+		case <-ticker.C:
+		}
+		pm.refreshDHT()
+	}
+}
+
+// joinDHT pings our seeds and then looks ourselves up, which fills our routing table
+// with our neighborhood and tells our neighbors about us.
+func (pm *PeerManager) joinDHT(seeds []string) {
+	var wg sync.WaitGroup
+	for _, seed := range seeds {
+		addr, err := net.ResolveUDPAddr("udp", seed)
+		if err != nil {
+			Log(WARNING, fmt.Sprintf("failed to resolve discovery seed %s: %v", seed, err))
+			continue
+		}
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			if _, err := pm.DHTPing(addr); err != nil {
+				Log(DEBUG, fmt.Sprintf("discovery seed %s did not answer: %v", addr, err))
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	found := pm.Lookup(pm.MyNode.NodeID)
+	Log(INFO, fmt.Sprintf("joined the discovery network, %d nodes in our neighborhood, %d in our routing table", len(found), pm.DHT.Size()))
+}
+
+// refreshDHT drops nodes that stopped answering, and looks up a random NodeID in each
+// bucket that hasn't been looked up recently so the whole table stays fresh.
+func (pm *PeerManager) refreshDHT() {
+	stale, oldest := pm.DHT.maintenance()
+
+	var wg sync.WaitGroup
+	for _, node := range oldest {
+		wg.Add(1)
+		go func(node *DHTNode) {
+			defer wg.Done()
+			if _, err := pm.DHTPing(node.Addr); err != nil {
+				Log(DEBUG, fmt.Sprintf("dropping unresponsive discovery node %s: %v", node.Contact.Record.NodeID, err))
+				pm.DHT.remove(node.Contact.Record.NodeID)
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	pm.Lookup(pm.MyNode.NodeID)
+	for _, bucket := range stale {
+		if pm.Context.Err() != nil {
+			return
+		}
+		pm.Lookup(randomNodeIDInBucket(pm.MyNode.NodeID, bucket))
+	}
+}
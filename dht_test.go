@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testDHTNode starts a discovery service on 127.0.0.1 that joins through seeds.
+func testDHTNode(t *testing.T, seeds ...string) *PeerManager {
+	t.Helper()
+	pm := testPeerManager(t, "127.0.0.1", 19876, TCPTransport{})
+	if err := pm.StartDHT("127.0.0.1:0", seeds); err != nil {
+		t.Fatal(err)
+	}
+	return pm
+}
+
+// routes reports whether nodeID is in the routing table d.
+func routes(d *DHTState, nodeID NodeID) bool {
+	for _, contact := range d.closest(nodeID, DHTBucketSize, "") {
+		if contact.Record.NodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// found reports whether contacts include nodeID.
+func found(contacts []DHTContact, nodeID NodeID) bool {
+	for _, contact := range contacts {
+		if contact.Record.NodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDHTLookup(t *testing.T) {
+	inTempDir(t)
+
+	seed := testDHTNode(t)
+	nodes := []*PeerManager{seed}
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, testDHTNode(t, seed.DHT.Conn.LocalAddr().String()))
+	}
+
+	// Every node only knows the seed to begin with, so finding the others takes a lookup through it
+	for i, node := range nodes {
+		for j, other := range nodes {
+			if i == j {
+				continue
+			}
+			eventually(t, 10*time.Second, fmt.Sprintf("node %d to find node %d", i, j), func() bool {
+				return found(node.Lookup(other.MyNode.NodeID), other.MyNode.NodeID)
+			})
+		}
+	}
+
+	// A node that goes away stops answering, and the next lookup that asks it drops it
+	gone := nodes[len(nodes)-1]
+	gone.Shutdown()
+	for i, node := range nodes[:len(nodes)-1] {
+		if !routes(node.DHT, gone.MyNode.NodeID) {
+			t.Fatalf("node %d lost the stopped node before looking for it", i)
+		}
+		if found(node.Lookup(gone.MyNode.NodeID), gone.MyNode.NodeID) {
+			t.Fatalf("node %d found a node that has stopped", i)
+		}
+		if routes(node.DHT, gone.MyNode.NodeID) {
+			t.Fatalf("node %d kept a node that did not answer its lookup", i)
+		}
+	}
+}
+
+func TestDHTBucketEviction(t *testing.T) {
+	// Bucket index holds nodes whose distance from us has index+1 bits, so it has room for 2^index of them
+	const index = 100
+	self := randomNodeID()
+	d := NewDHTState(self, nil)
+	node := func() *DHTNode {
+		var record PeerRecord
+		record.NodeID = randomNodeIDInBucket(self, index)
+		return &DHTNode{Contact: DHTContact{Record: record}, LastSeen: time.Now()}
+	}
+
+	bucket := make([]*DHTNode, DHTBucketSize)
+	for i := range bucket {
+		bucket[i] = node()
+		if oldest := d.seen(bucket[i]); oldest != nil {
+			t.Fatalf("bucket reported full after %d nodes", i)
+		}
+	}
+
+	// Hearing from a node again moves it to the most recently seen end
+	d.seen(bucket[0])
+	bucket = append(bucket[1:], bucket[0])
+
+	// A newcomer to a full bucket has to wait for the least recently seen node to be checked, once
+	newcomer := node()
+	if oldest := d.seen(newcomer); oldest != bucket[0] {
+		t.Fatal("full bucket did not ask for its least recently seen node to be checked")
+	}
+	if oldest := d.seen(node()); oldest != nil {
+		t.Fatal("full bucket asked for the same node to be checked twice")
+	}
+
+	// A node that answers stays and the newcomer is dropped
+	d.replace(bucket[0], newcomer, true)
+	if !routes(d, bucket[0].Contact.Record.NodeID) || routes(d, newcomer.Contact.Record.NodeID) {
+		t.Fatal("live node was replaced")
+	}
+
+	// A node that doesn't is replaced by the newcomer
+	if oldest := d.seen(newcomer); oldest != bucket[0] {
+		t.Fatal("full bucket did not ask for its least recently seen node to be checked again")
+	}
+	d.replace(bucket[0], newcomer, false)
+	if routes(d, bucket[0].Contact.Record.NodeID) || !routes(d, newcomer.Contact.Record.NodeID) {
+		t.Fatal("dead node was not replaced by the newcomer")
+	}
+	if size := d.Size(); size != DHTBucketSize {
+		t.Fatalf("routing table holds %d nodes, want %d", size, DHTBucketSize)
+	}
+
+	// Buckets nobody has looked up for DHTBucketStale are due a refresh, and their oldest node a liveness check
+	d.Refreshed[index] = time.Now().Add(-2 * DHTBucketStale)
+	stale, oldest := d.maintenance()
+	if len(stale) != 1 || stale[0] != index {
+		t.Fatalf("got stale buckets %v, want [%d]", stale, index)
+	}
+	if len(oldest) != 1 || oldest[0] != bucket[1] {
+		t.Fatal("maintenance did not check the least recently seen node")
+	}
+	d.markRefreshed(randomNodeIDInBucket(self, index))
+	if stale, _ := d.maintenance(); len(stale) != 0 {
+		t.Fatalf("bucket still stale after a lookup: %v", stale)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (r *PeerRecord) Hash() Hash {
+	h := sha256.New()
+
+	// Add record fields to hash
+	h.Write([]byte(r.NodeID))
+	h.Write(r.PublicKey[:])
+	h.Write(r.Address.To16())
+	binary.Write(h, binary.LittleEndian, r.Port)
+	binary.Write(h, binary.LittleEndian, r.LastSeen.Unix())
+	binary.Write(h, binary.LittleEndian, r.Services)
+
+	return Hash(sha256.Sum256(h.Sum(nil)))
+}
+
+func (r *PeerRecord) Sign(key PrivateKey) error {
+	recordHash := r.Hash()
+
+	// Generate the signature
+	signature := ed25519.Sign(ed25519.PrivateKey(key[:]), recordHash[:])
+
+	// Check that the signature is correct length
+	if len(signature) != len(r.Signature) {
+		return errors.New("signature generation failed")
+	}
+
+	copy(r.Signature[:], signature)
+	return nil
+}
+
+func (r *PeerRecord) Validate() error {
+	recordHash := r.Hash()
+
+	// Verify that the peer signed its own record
+	if !ed25519.Verify(ed25519.PublicKey(r.PublicKey[:]), recordHash[:], r.Signature[:]) {
+		return errors.New("peer record signature is invalid")
+	}
+
+	if r.NodeID != NodeIDFromKey(r.PublicKey) {
+		return errors.New("peer record NodeID does not match its public key")
+	}
+
+	if r.LastSeen.After(time.Now().Add(10 * time.Minute)) {
+		return errors.New("peer record is from the future")
+	}
+
+	return nil
+}
+
+// Verify checks that the record is validly signed and belongs to the peer identified by nodeID and publicKey.
+func (r *PeerRecord) Verify(nodeID NodeID, publicKey PublicKey) error {
+	if r == nil {
+		return errors.New("missing peer record")
+	}
+	if r.NodeID != nodeID || r.PublicKey != publicKey {
+		return errors.New("peer record does not match peer identity")
+	}
+	return r.Validate()
+}
+
+// Dialable reports whether the record carries an address we could connect to.
+func (r *PeerRecord) Dialable() bool {
+	return r.Address != nil && !r.Address.IsUnspecified() && r.Port != 0
+}
+
+// CurrentRecord returns the peer's latest signed record.
+func (p *Peer) CurrentRecord() *PeerRecord {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	return p.Record
+}
+
+// setRecord replaces the peer's record with a newer one.
+func (p *Peer) setRecord(record *PeerRecord) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	p.Record = record
+}
+
+// MyRecord returns a freshly signed record describing our own node.
+func (pm *PeerManager) MyRecord() (*PeerRecord, error) {
+	services := ServiceFullNode
+	if pm.Light != nil {
+		services = 0
+	}
+
+	pm.Address.Mutex.Lock()
+	record := &PeerRecord{
+		NodeID:    pm.MyNode.NodeID,
+		PublicKey: pm.MyNode.PublicKey,
+		Address:   pm.MyNode.Address,
+		Port:      pm.MyNode.Port,
+		LastSeen:  time.Now(),
+		Services:  services,
+	}
+	pm.Address.Mutex.Unlock()
+	if err := record.Sign(pm.Keys.PrivateKey); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// handleDiscoverPeersRequest answers with the signed records of the peers we are connected to,
+// leaving out the requester and any peers it already knows. A peer whose record has no address, as it
+// hasn't learned its public one yet, is listed apart with the address we see it at, which it didn't sign.
+func (pm *PeerManager) handleDiscoverPeersRequest(p *Peer, message *Message) {
+	known := make(map[NodeID]bool)
+	known[p.NodeID] = true
+	if message.Request != nil {
+		for _, nodeID := range message.Request.KnownPeers {
+			known[nodeID] = true
+		}
+	}
+
+	records := make([]PeerRecord, 0)
+	observed := make([]ObservedPeer, 0)
+	for _, peer := range pm.Peers.List() {
+		if len(records)+len(observed) >= MaxPeerRecords {
+			break
+		}
+		record := peer.CurrentRecord()
+		if known[peer.NodeID] || record == nil {
+			continue
+		}
+		if record.Address == nil && record.Port != 0 {
+			observed = append(observed, ObservedPeer{Record: *record, Address: peer.Address})
+			continue
+		}
+		if !record.Dialable() {
+			continue
+		}
+		records = append(records, *record)
+	}
+
+	response := &Message{
+		Type:     MessageTypeDiscoverPeersResponse,
+		Response: &DiscoverPeersResponse{Peers: records, Observed: observed},
+	}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send DiscoverPeersResponse to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// Discovers new peers by sending a DiscoverPeersRequest to all known peers. Validly signed
+// peer records we get back go into the address book and are dialed if we have free outbound slots.
+func (pm *PeerManager) DiscoverPeers() {
+	Log(DEBUG, "discovering new peers..")
+
+	peers := pm.Peers.List()
+	knownPeers := make([]NodeID, 0, len(peers))
+	for _, peer := range peers {
+		Log(DEBUG, "adding peer: "+string(peer.NodeID))
+		knownPeers = append(knownPeers, peer.NodeID)
+	}
+
+	request := &DiscoverPeersRequest{KnownPeers: knownPeers}
+
+	learned := 0
+	for _, peer := range peers {
+		response, err := peer.SendDiscoverPeersRequest(request)
+		if err != nil {
+			Log(DEBUG, fmt.Sprintf("peer discovery with %s failed: %v", peer.NodeID, err))
+			continue
+		}
+
+		for _, record := range response.Peers {
+			if err := record.Validate(); err != nil {
+				pm.Misbehaving(peer, OffenseBadRecord, err.Error())
+				break
+			}
+			if record.NodeID == pm.MyNode.NodeID || !record.Dialable() || time.Since(record.LastSeen) > PeerRecordTTL {
+				continue
+			}
+			pm.Book.Add(record, peer.Address)
+			learned++
+		}
+		for _, observed := range response.Observed {
+			if err := observed.Record.Validate(); err != nil {
+				pm.Misbehaving(peer, OffenseBadRecord, err.Error())
+				break
+			}
+			if observed.Record.NodeID == pm.MyNode.NodeID || time.Since(observed.Record.LastSeen) > PeerRecordTTL {
+				continue
+			}
+			if pm.Book.AddObserved(observed.Record, observed.Address, peer.Address) {
+				learned++
+			}
+		}
+	}
+
+	// Dial whatever we learned, up to our free outbound slots
+	if learned > 0 {
+		pm.ConnectToKnownPeers(pm.freeOutboundSlots())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoverPeersWithoutAddress(t *testing.T) {
+	inTempDir(t)
+
+	network := NewMemoryNetwork()
+	a := testNode(t, network, "10.1.0.1")
+	b := testNode(t, network, "10.2.0.1")
+	c := testNode(t, network, "10.3.0.1")
+	hub, address := b.MyNode.Address, c.MyNode.Address
+
+	// None of the nodes has learned its public address yet, so their records don't carry one
+	for _, node := range []*PeerManager{a, b, c} {
+		node.MyNode.Address = nil
+	}
+	if _, err := a.ConnectToPeer(hub, b.MyNode.Port); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ConnectToPeer(hub, b.MyNode.Port); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, "b to have both peers", func() bool {
+		return b.Peers.Count() == 2
+	})
+
+	// b tells a where it sees c, and a dials it there
+	a.DiscoverPeers()
+	eventually(t, 5*time.Second, "a to connect to c", func() bool {
+		return a.Peers.Get(c.MyNode.NodeID) != nil
+	})
+	peer := a.Peers.Get(c.MyNode.NodeID)
+	if !peer.Address.Equal(address) || peer.Port != c.MyNode.Port {
+		t.Fatalf("a reached c at %s, want %s", AddressKey(peer.Address, peer.Port), AddressKey(address, c.MyNode.Port))
+	}
+}
+
+func TestPeerRecordAddressIsSigned(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := PeerRecord{NodeID: NodeIDFromKey(keys.PublicKey), PublicKey: keys.PublicKey, Port: 19876, LastSeen: time.Now()}
+	if err := record.Sign(keys.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := record.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever relays a record without an address must not be able to give it one
+	record.Address = net.IPv4(10, 9, 0, 1)
+	if err := record.Validate(); err == nil {
+		t.Fatal("record with an address it wasn't signed with passed validation")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NewAddressVotes creates an empty tally of the addresses our peers see us at.
+func NewAddressVotes() *AddressVotes {
+	return &AddressVotes{
+		Mutex: new(sync.Mutex),
+		Votes: make(map[string]AddressVote),
+	}
+}
+
+// SetExternalAddress fixes the address we advertise, ignoring what our peers report from then on.
+func (pm *PeerManager) SetExternalAddress(address string) error {
+	ip, externalPort, err := parseExternalAddress(address)
+	if err != nil {
+		return err
+	}
+
+	pm.Address.Mutex.Lock()
+	pm.MyNode.Address = ip
+	if externalPort != 0 {
+		pm.MyNode.Port = externalPort
+	}
+	pm.Address.Override = true
+	advertised := AddressKey(pm.MyNode.Address, pm.MyNode.Port)
+	pm.Address.Mutex.Unlock()
+
+	Log(INFO, fmt.Sprintf("advertising external address %s", advertised))
+	return nil
+}
+
+// VoteAddress records the address a peer at reporter saw us at. Only peers we reached ourselves may vote, as
+// anyone can reach us and make up keys, and each network group has one vote. Once MinAddressVotes groups agree
+// on an address that more groups report than our current one, we switch to it and advertise it.
+func (pm *PeerManager) VoteAddress(reporter net.IP, address net.IP) {
+	if address == nil || address.IsUnspecified() {
+		return
+	}
+
+	pm.Address.Mutex.Lock()
+	if pm.Address.Override {
+		pm.Address.Mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	pm.Address.Votes[string(NetworkGroup(reporter))] = AddressVote{Address: address, Time: now}
+
+	// Count the votes that are still fresh
+	tally := make(map[string]int)
+	for voter, vote := range pm.Address.Votes {
+		if now.Sub(vote.Time) > AddressVoteTTL {
+			delete(pm.Address.Votes, voter)
+			continue
+		}
+		tally[vote.Address.String()]++
+	}
+	var best string
+	for candidate, votes := range tally {
+		if votes > tally[best] {
+			best = candidate
+		}
+	}
+
+	changed := false
+	current := ""
+	if pm.MyNode.Address != nil {
+		current = pm.MyNode.Address.String()
+	}
+	if best != current && tally[best] >= MinAddressVotes && tally[best] > tally[current] {
+		pm.MyNode.Address = net.ParseIP(best)
+		changed = true
+	}
+	pm.Address.Mutex.Unlock()
+
+	if changed {
+		Log(INFO, fmt.Sprintf("our external address is %s, as seen from %d network groups", best, tally[best]))
+		pm.advertiseRecord()
+		if pm.DHT != nil {
+			// Looking ourselves up hands our new record to the nodes closest to us on the discovery network
+			go pm.Lookup(pm.MyNode.NodeID)
+		}
+	}
+}
+
+// advertiseRecord sends our freshly signed record to every peer, so they can pass on our new address.
+func (pm *PeerManager) advertiseRecord() {
+	record, err := pm.MyRecord()
+	if err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to sign our peer record: %v", err))
+		return
+	}
+
+	message := &Message{Type: MessageTypePeerRecord, Record: record}
+	for _, peer := range pm.Peers.List() {
+		if err := peer.sendMessage(message); err != nil {
+			Log(DEBUG, fmt.Sprintf("Failed to send our peer record to peer %s: %v", peer.NodeID, err))
+		}
+	}
+}
+
+// handlePeerRecord replaces a peer's record with the updated one it sent us.
+func (pm *PeerManager) handlePeerRecord(p *Peer, record *PeerRecord) {
+	if err := record.Verify(p.NodeID, p.PublicKey); err != nil {
+		pm.Misbehaving(p, OffenseBadRecord, err.Error())
+		return
+	}
+
+	p.setRecord(record)
+	pm.Book.Add(*record, p.Address)
+}
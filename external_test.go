@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestVoteAddressByNetworkGroup(t *testing.T) {
+	inTempDir(t)
+	pm := testPeerManager(t, "", 19876, nil)
+	claimed := net.IPv4(203, 0, 113, 7)
+
+	// Any number of reporters in one network group are a single vote
+	for i := 1; i <= 2*MinAddressVotes; i++ {
+		pm.VoteAddress(net.IPv4(10, 1, 0, byte(i)), claimed)
+	}
+	if pm.MyNode.Address != nil {
+		t.Fatalf("switched to %s on the votes of a single network group", pm.MyNode.Address)
+	}
+
+	for i := 2; i <= MinAddressVotes; i++ {
+		pm.VoteAddress(net.IPv4(10, byte(i), 0, 1), claimed)
+	}
+	if !pm.MyNode.Address.Equal(claimed) {
+		t.Fatalf("got address %s after %d network groups agreed, want %s", pm.MyNode.Address, MinAddressVotes, claimed)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// filterItems returns what a block's filter is built from: the sender and recipient keys of its transactions.
+func filterItems(block *Block) [][]byte {
+	items := make([][]byte, 0, 2*len(block.Transactions))
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		items = append(items, tx.Sender[:], tx.Recipient[:])
+	}
+	return items
+}
+
+// keyItems returns keys in the form filters are matched against.
+func keyItems(keys []PublicKey) [][]byte {
+	items := make([][]byte, len(keys))
+	for i := range keys {
+		items[i] = keys[i][:]
+	}
+	return items
+}
+
+// FilterHeader chains filter onto the header of the filter before it.
+func FilterHeader(filter []byte, prev Hash) Hash {
+	filterHash := sha256.Sum256(filter)
+	return sha256.Sum256(append(filterHash[:], prev[:]...))
+}
+
+// NewBlockFilter builds the filter of block, chained onto prev, the filter header of its parent.
+func NewBlockFilter(block *Block, prev Hash) BlockFilter {
+	filter := BuildFilter(block.BlockHash, filterItems(block))
+	return BlockFilter{
+		Height:    block.Height,
+		BlockHash: block.BlockHash,
+		Filter:    filter,
+		Header:    FilterHeader(filter, prev),
+	}
+}
+
+// addFilter builds the filter of a block that was just appended to the chain. The caller must hold c.Mutex.
+func (c *Chain) addFilter(block *Block) {
+	var prev Hash
+	if len(c.Filters) > 0 {
+		prev = c.Filters[len(c.Filters)-1].Header
+	}
+	c.Filters = append(c.Filters, NewBlockFilter(block, prev))
+}
+
+// FiltersFrom returns up to max filters from the block at height start, stopping after stop.
+func (c *Chain) FiltersFrom(start uint64, stop Hash, max int) []BlockFilter {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	filters := make([]BlockFilter, 0)
+	if start < 1 {
+		start = 1
+	}
+	for i := start - 1; i < uint64(len(c.Filters)) && len(filters) < max; i++ {
+		filters = append(filters, c.Filters[i])
+		if c.Filters[i].BlockHash == stop {
+			break
+		}
+	}
+	return filters
+}
+
+// MatchingBlocks returns the blocks from height from on whose filters match any of keys.
+func (c *Chain) MatchingBlocks(keys []PublicKey, from uint64) []Block {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	items := keyItems(keys)
+	blocks := make([]Block, 0)
+	if from < 1 {
+		from = 1
+	}
+	for i := from - 1; i < uint64(len(c.Filters)); i++ {
+		if match, _ := MatchFilter(c.Filters[i].Filter, c.Filters[i].BlockHash, items); match {
+			blocks = append(blocks, c.BlockHistory[i])
+		}
+	}
+	return blocks
+}
+
+// handleGetFilters answers with the filters of our blocks from the requested height.
+func (pm *PeerManager) handleGetFilters(p *Peer, message *Message) {
+	if message.GetFilters == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetFilters without a body")
+		return
+	}
+
+	response := &Message{
+		Type:    MessageTypeFilters,
+		Filters: pm.Chain.FiltersFrom(message.GetFilters.StartHeight, message.GetFilters.Stop, MaxFilters),
+	}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send filters to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// handleGetFilterHeaders answers like handleGetFilters, but without the filters themselves.
+func (pm *PeerManager) handleGetFilterHeaders(p *Peer, message *Message) {
+	if message.GetFilters == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetFilterHeaders without a body")
+		return
+	}
+
+	filters := pm.Chain.FiltersFrom(message.GetFilters.StartHeight, message.GetFilters.Stop, MaxFilters)
+	for i := range filters {
+		filters[i].Filter = nil
+	}
+	response := &Message{Type: MessageTypeFilters, Filters: filters}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send filter headers to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// SendGetFilters asks the peer for the filters of its blocks from the requested height.
+func (p *Peer) SendGetFilters(request *GetFiltersRequest) ([]BlockFilter, error) {
+	return p.requestFilters(MessageTypeGetFilters, request)
+}
+
+// SendGetFilterHeaders asks the peer for the filter headers of its blocks from the requested height.
+func (p *Peer) SendGetFilterHeaders(request *GetFiltersRequest) ([]BlockFilter, error) {
+	return p.requestFilters(MessageTypeGetFilterHeaders, request)
+}
+
+func (p *Peer) requestFilters(messageType MessageType, request *GetFiltersRequest) ([]BlockFilter, error) {
+	response, err := p.Request(&Message{Type: messageType, GetFilters: request})
+	if err != nil {
+		return nil, err
+	}
+	if response.Type != MessageTypeFilters {
+		return nil, fmt.Errorf("unexpected message type received: %v", response.Type)
+	}
+	return response.Filters, nil
+}
+
+// ScanFilters returns the blocks from height from on that send to or from any of keys. A light client
+// matches the filters of its fastest full node peer and fetches only the blocks that match, so the peer
+// never learns which keys are ours. The filter headers are checked against our other full node peers,
+// since a peer leaving our keys out of a filter would otherwise hide payments from us.
+func (pm *PeerManager) ScanFilters(keys []PublicKey, from uint64) ([]Block, error) {
+	if from < 1 {
+		from = 1
+	}
+	if pm.Light == nil {
+		return pm.Chain.MatchingBlocks(keys, from), nil
+	}
+
+	peers := make([]*Peer, 0)
+	for _, peer := range pm.PeersByLatency() {
+		if peer.FullNode() {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("no full node peers to get filters from")
+	}
+	source, witnesses := peers[0], peers[1:]
+
+	items := keyItems(keys)
+	blocks := make([]Block, 0)
+	tip := pm.Light.Height()
+
+	// The filter before from anchors the chain of filter headers we check
+	next := from
+	var prev BlockFilter
+	if from > 1 {
+		next = from - 1
+	}
+	for next <= tip {
+		filters, err := source.SendGetFilters(&GetFiltersRequest{StartHeight: next})
+		if err != nil {
+			return nil, err
+		}
+		if len(filters) == 0 {
+			return nil, fmt.Errorf("peer %s has no filters from height %d", source.NodeID, next)
+		}
+
+		start := next
+		checked := make([]BlockFilter, 0, 2)
+		for _, filter := range filters {
+			header, exists := pm.Light.Header(filter.Height)
+			if filter.Height != next || !exists {
+				break
+			}
+			if filter.BlockHash != header.BlockHash {
+				return nil, fmt.Errorf("peer %s sent the filter of block %x, which is not on our chain", source.NodeID, filter.BlockHash)
+			}
+			if filter.Height < from {
+				checked = append(checked, filter)
+				prev = filter
+				next++
+				continue
+			}
+			if filter.Header != FilterHeader(filter.Filter, prev.Header) {
+				pm.Misbehaving(source, OffenseInvalidProof, fmt.Sprintf("filter header %d does not chain", filter.Height))
+				return nil, fmt.Errorf("peer %s sent filter headers that do not chain", source.NodeID)
+			}
+			prev = filter
+			next++
+
+			match, err := MatchFilter(filter.Filter, filter.BlockHash, items)
+			if err != nil {
+				pm.Misbehaving(source, OffenseInvalidProof, err.Error())
+				return nil, fmt.Errorf("peer %s sent filter %d: %w", source.NodeID, filter.Height, err)
+			}
+			if match {
+				block, err := pm.fetchFilteredBlock(source, &header, filter)
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, *block)
+			}
+		}
+		if next == start {
+			return nil, fmt.Errorf("peer %s did not send the filter of block %d", source.NodeID, start)
+		}
+		checked = append(checked, prev)
+
+		if err := pm.crossCheckFilters(source, witnesses, checked); err != nil {
+			return nil, err
+		}
+		if len(filters) < MaxFilters {
+			break
+		}
+	}
+	return blocks, nil
+}
+
+// fetchFilteredBlock downloads the block of a matching filter and checks that both match our header.
+func (pm *PeerManager) fetchFilteredBlock(p *Peer, header *BlockHeader, filter BlockFilter) (*Block, error) {
+	blocks, err := p.SendGetBlocks(&GetBlocksRequest{Locator: []Hash{header.ParentHash}, Stop: header.BlockHash})
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 || blocks[0].BlockHash != header.BlockHash || blocks[0].Hash() != header.BlockHash {
+		pm.Misbehaving(p, OffenseInvalidBlock, fmt.Sprintf("block %d does not match its header", header.Height))
+		return nil, fmt.Errorf("peer %s sent a block that does not match header %d", p.NodeID, header.Height)
+	}
+	if !bytes.Equal(BuildFilter(header.BlockHash, filterItems(&blocks[0])), filter.Filter) {
+		pm.Misbehaving(p, OffenseInvalidProof, fmt.Sprintf("filter %d does not match its block", header.Height))
+		return nil, fmt.Errorf("peer %s sent a filter that does not match block %d", p.NodeID, header.Height)
+	}
+	return &blocks[0], nil
+}
+
+// crossCheckFilters asks each witness for the filter headers in filters and fails if any disagrees with source.
+// We can't tell which of two disagreeing peers is lying without every block in between, so the scan fails instead.
+func (pm *PeerManager) crossCheckFilters(source *Peer, witnesses []*Peer, filters []BlockFilter) error {
+	for _, witness := range witnesses {
+		for _, filter := range filters {
+			headers, err := witness.SendGetFilterHeaders(&GetFiltersRequest{StartHeight: filter.Height, Stop: filter.BlockHash})
+			if err != nil || len(headers) == 0 || headers[0].BlockHash != filter.BlockHash {
+				// The witness may be behind us or on another chain, so it has nothing to say
+				continue
+			}
+			if headers[0].Header != filter.Header {
+				return fmt.Errorf("peers %s and %s disagree on the filter header of block %d", source.NodeID, witness.NodeID, filter.Height)
+			}
+		}
+	}
+	return nil
+}
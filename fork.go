@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// AllowsForks reports whether our consensus has fork choice, so that we keep side chains and may switch to one.
+func (c *Chain) AllowsForks() bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return c.allowsForksLocked()
+}
+
+// allowsForksLocked is AllowsForks for a caller that holds c.Mutex.
+func (c *Chain) allowsForksLocked() bool {
+	return c.Consensus.Work(&BlockHeader{}) != nil
+}
+
+// Knows reports whether we hold the block with hash, on our chain or on a side chain.
+func (c *Chain) Knows(hash Hash) bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if _, exists := c.Side[hash]; exists {
+		return true
+	}
+	return c.indexOfLocked(hash) >= 0
+}
+
+// indexOfLocked returns the index in BlockHistory of the block with hash, or -1 if it isn't on our chain.
+// The search starts at the tip, where the blocks we look for usually are. The caller must hold c.Mutex.
+func (c *Chain) indexOfLocked(hash Hash) int {
+	for i := len(c.BlockHistory) - 1; i >= 0; i-- {
+		if c.BlockHistory[i].BlockHash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// ancestorsLocked returns up to n blocks ending with the one with hash, newest first, following side chain
+// blocks back onto our chain. It returns fewer if the chain they are on is shorter. The caller must hold c.Mutex.
+func (c *Chain) ancestorsLocked(hash Hash, n int) []*Block {
+	ancestors := make([]*Block, 0, n)
+	for len(ancestors) < n {
+		if block, exists := c.Side[hash]; exists {
+			ancestors = append(ancestors, &block)
+			hash = block.ParentHash
+			continue
+		}
+		for i := c.indexOfLocked(hash); i >= 0 && len(ancestors) < n; i-- {
+			ancestors = append(ancestors, &c.BlockHistory[i])
+		}
+		break
+	}
+	return ancestors
+}
+
+// branchLocked returns the side chain blocks from where block's branch leaves our chain up to block itself,
+// oldest first, and the height of the last block the branch has in common with our chain. It returns false
+// if the branch doesn't lead back to our chain. The caller must hold c.Mutex.
+func (c *Chain) branchLocked(block Block) ([]Block, uint64, bool) {
+	branch := []Block{block}
+	for {
+		side, exists := c.Side[block.ParentHash]
+		if !exists {
+			break
+		}
+		if side.Height+1 != block.Height {
+			return nil, 0, false
+		}
+		branch = append(branch, side)
+		block = side
+	}
+
+	fork := block.Height - 1
+	if fork > uint64(len(c.BlockHistory)) {
+		return nil, 0, false
+	}
+	if fork == 0 && block.ParentHash != (Hash{}) || fork > 0 && c.BlockHistory[fork-1].BlockHash != block.ParentHash {
+		return nil, 0, false
+	}
+
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+	return branch, fork, true
+}
+
+// addSideBlockLocked keeps a valid block that doesn't extend our tip, and switches our chain over to its
+// branch if the branch now has more work than our own blocks since the fork. The caller must hold c.Mutex.
+func (c *Chain) addSideBlockLocked(block Block) error {
+	if _, exists := c.Side[block.BlockHash]; exists {
+		return nil
+	}
+	if c.indexOfLocked(block.BlockHash) >= 0 {
+		return errors.New("block is already on our chain")
+	}
+
+	branch, fork, ok := c.branchLocked(block)
+	if !ok {
+		return fmt.Errorf("block %d does not connect to our chain or a side chain we hold", block.Height)
+	}
+	if uint64(len(c.BlockHistory))-fork > MaxForkDepth {
+		return fmt.Errorf("block %d forks from our chain at %d, more than %d blocks back", block.Height, fork, MaxForkDepth)
+	}
+	if err := c.verifyLocked(&block); err != nil {
+		return err
+	}
+	c.Side[block.BlockHash] = block
+
+	if c.workLocked(branch).Cmp(c.workLocked(c.BlockHistory[fork:])) <= 0 {
+		Log(DEBUG, fmt.Sprintf("keeping block %d (%x) on a side chain forked at %d", block.Height, block.BlockHash, fork))
+		return nil
+	}
+	return c.reorgLocked(branch, fork)
+}
+
+// workLocked returns the total work of blocks. The caller must hold c.Mutex.
+func (c *Chain) workLocked(blocks []Block) *big.Int {
+	total := new(big.Int)
+	for i := range blocks {
+		header := blocks[i].Header()
+		total.Add(total, c.Consensus.Work(&header))
+	}
+	return total
+}
+
+// reorgLocked replaces our blocks after height fork with branch. The blocks we drop are kept as a side chain
+// and their transactions go back into the pending pool unless branch confirms them too. If a block of branch
+// turns out to be invalid we go back to our own blocks and forget it and the blocks after it.
+// The caller must hold c.Mutex.
+func (c *Chain) reorgLocked(branch []Block, fork uint64) error {
+	dropped := append([]Block(nil), c.BlockHistory[fork:]...)
+	pending := append([]Transaction(nil), c.PendingTransactions...)
+
+	c.truncateLocked(fork)
+	for i, block := range branch {
+		if err := c.extendLocked(block); err != nil {
+			for _, bad := range branch[i:] {
+				delete(c.Side, bad.BlockHash)
+			}
+			c.truncateLocked(fork)
+			for _, ours := range dropped {
+				c.appendBlock(ours, c.nextState(&ours))
+			}
+			c.PendingTransactions = pending
+			return fmt.Errorf("side chain block %d: %w", block.Height, err)
+		}
+	}
+
+	for _, block := range branch {
+		delete(c.Side, block.BlockHash)
+	}
+	inPool := make(map[Hash]bool, len(c.PendingTransactions))
+	for _, tx := range c.PendingTransactions {
+		inPool[tx.TxHash] = true
+	}
+	returned := 0
+	for _, block := range dropped {
+		c.Side[block.BlockHash] = block
+		for _, tx := range block.Transactions {
+			if _, confirmed := c.TxIndex[tx.TxHash]; !confirmed && !inPool[tx.TxHash] {
+				c.PendingTransactions = append(c.PendingTransactions, tx)
+				inPool[tx.TxHash] = true
+				returned++
+			}
+		}
+	}
+	Log(INFO, fmt.Sprintf("switched to a chain with more work at block %d, replacing %d block(s) with %d and returning %d transaction(s) to the pending pool",
+		fork, len(dropped), len(branch), returned))
+	return nil
+}
+
+// truncateLocked drops our blocks above height and replays the account state of the rest.
+// The caller must hold c.Mutex.
+func (c *Chain) truncateLocked(height uint64) {
+	for _, block := range c.BlockHistory[height:] {
+		for _, tx := range block.Transactions {
+			delete(c.TxIndex, tx.TxHash)
+		}
+	}
+	c.BlockHistory = c.BlockHistory[:height]
+	c.Filters = c.Filters[:height]
+
+	c.State = make(map[PublicKey]*Account)
+	for i := range c.BlockHistory {
+		applyBlock(c.State, &c.BlockHistory[i])
+	}
+}
+
+// pruneSideLocked forgets side chain blocks too far below our tip to ever be switched to.
+// The caller must hold c.Mutex.
+func (c *Chain) pruneSideLocked() {
+	height := uint64(len(c.BlockHistory))
+	for hash, block := range c.Side {
+		if block.Height+MaxForkDepth < height {
+			delete(c.Side, hash)
+		}
+	}
+}
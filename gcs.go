@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// Block filters are Golomb-coded sets as in BIP 158. Each item is hashed into the range [0, N*M),
+// the sorted values are delta encoded and each delta is written as a unary quotient followed by
+// FilterP remainder bits. A wallet matching its keys gets a false positive about once in M blocks.
+const (
+	FilterP = 19
+	FilterM = 784931
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// filterKey derives the hashing key of a block's filter from its hash, so a filter can't be
+// crafted ahead of time to collide with someone's keys.
+func filterKey(blockHash Hash) [16]byte {
+	var key [16]byte
+	copy(key[:], blockHash[:16])
+	return key
+}
+
+// hashToRange maps item uniformly into [0, f).
+func hashToRange(key [16]byte, item []byte, f uint64) uint64 {
+	h := sha256.New()
+	h.Write(key[:])
+	h.Write(item)
+	sum := h.Sum(nil)
+	hi, _ := bits.Mul64(binary.LittleEndian.Uint64(sum[:8]), f)
+	return hi
+}
+
+// hashedSet returns the sorted, deduplicated range values of items for a filter of n items.
+func hashedSet(key [16]byte, items [][]byte, n uint64) []uint64 {
+	f := n * FilterM
+	values := make([]uint64, 0, len(items))
+	for _, item := range items {
+		values = append(values, hashToRange(key, item, f))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	unique := values[:0]
+	for i, value := range values {
+		if i == 0 || value != values[i-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// BuildFilter encodes items as the filter of the block with blockHash. Duplicate items are only counted once.
+func BuildFilter(blockHash Hash, items [][]byte) []byte {
+	distinct := make(map[string]bool, len(items))
+	for _, item := range items {
+		distinct[string(item)] = true
+	}
+	n := uint64(len(distinct))
+
+	filter := binary.AppendUvarint(nil, n)
+	if n == 0 {
+		return filter
+	}
+
+	unique := make([][]byte, 0, n)
+	for item := range distinct {
+		unique = append(unique, []byte(item))
+	}
+
+	w := bitWriter{data: filter}
+	var last uint64
+	for _, value := range hashedSet(filterKey(blockHash), unique, n) {
+		delta := value - last
+		last = value
+		for q := delta >> FilterP; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, FilterP)
+	}
+	return w.data
+}
+
+// MatchFilter reports whether any of items may be in the filter of the block with blockHash.
+// It never misses an item that is in the filter, but about one in FilterM other items match too.
+func MatchFilter(filter []byte, blockHash Hash, items [][]byte) (bool, error) {
+	n, read := binary.Uvarint(filter)
+	if read <= 0 {
+		return false, ErrInvalidFilter
+	}
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+	if n > uint64(len(filter))*8 {
+		return false, ErrInvalidFilter
+	}
+
+	wanted := hashedSet(filterKey(blockHash), items, n)
+	r := bitReader{data: filter[read:]}
+	var value uint64
+	next := 0
+	for i := uint64(0); i < n; i++ {
+		var q uint64
+		for {
+			bit, ok := r.readBit()
+			if !ok {
+				return false, ErrInvalidFilter
+			}
+			if bit == 0 {
+				break
+			}
+			q++
+		}
+		remainder, ok := r.readBits(FilterP)
+		if !ok {
+			return false, ErrInvalidFilter
+		}
+		value += q<<FilterP | remainder
+
+		for next < len(wanted) && wanted[next] < value {
+			next++
+		}
+		if next == len(wanted) {
+			return false, nil
+		}
+		if wanted[next] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bitWriter appends bits to data, most significant bit first.
+type bitWriter struct {
+	data []byte
+	used uint8 // This is how many bits of the last byte are in use, 0 meaning it is full.
+}
+
+func (w *bitWriter) writeBit(bit uint64) {
+	if w.used == 0 {
+		w.data = append(w.data, 0)
+	}
+	if bit != 0 {
+		w.data[len(w.data)-1] |= 0x80 >> w.used
+	}
+	w.used = (w.used + 1) % 8
+}
+
+func (w *bitWriter) writeBits(value uint64, count int) {
+	for i := count - 1; i >= 0; i-- {
+		w.writeBit(value >> uint(i) & 1)
+	}
+}
+
+// bitReader reads the bits written by a bitWriter.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (uint64, bool) {
+	if r.pos >= len(r.data)*8 {
+		return 0, false
+	}
+	bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint64(bit), true
+}
+
+func (r *bitReader) readBits(count int) (uint64, bool) {
+	var value uint64
+	for i := 0; i < count; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		value = value<<1 | bit
+	}
+	return value, true
+}
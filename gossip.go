@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NewSeenCache creates a cache that remembers hashes for ttl.
+func NewSeenCache(ttl time.Duration) *SeenCache {
+	return &SeenCache{
+		Mutex:     new(sync.Mutex),
+		Entries:   make(map[Hash]time.Time),
+		TTL:       ttl,
+		LastPrune: time.Now(),
+	}
+}
+
+// Has reports whether hash has been seen, without recording it.
+func (sc *SeenCache) Has(hash Hash) bool {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+
+	seen, exists := sc.Entries[hash]
+	return exists && time.Since(seen) <= sc.TTL
+}
+
+// Add records hash as seen. It returns false if the hash had already been seen.
+func (sc *SeenCache) Add(hash Hash) bool {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(sc.LastPrune) > sc.TTL {
+		for h, seen := range sc.Entries {
+			if now.Sub(seen) > sc.TTL {
+				delete(sc.Entries, h)
+			}
+		}
+		sc.LastPrune = now
+	}
+
+	if seen, exists := sc.Entries[hash]; exists && now.Sub(seen) <= sc.TTL {
+		return false
+	}
+	sc.Entries[hash] = now
+	return true
+}
+
+// handleBlock validates a gossiped block, adds it to the chain and relays it to our other peers.
+// The block is only marked as seen once it has been accepted, since its hash doesn't cover its
+// signature and a copy with a broken signature must not keep the real block out.
+func (pm *PeerManager) handleBlock(from *Peer, block *Block) {
+	if block == nil {
+		pm.Misbehaving(from, OffenseMalformedMessage, "block message without a block")
+		return
+	}
+	if pm.Seen.Has(block.BlockHash) {
+		from.known.Add(block.BlockHash)
+		return
+	}
+	if pm.Light != nil {
+		header := block.Header()
+		pm.acceptHeader(from, &header)
+		return
+	}
+	pm.acceptBlock(from, block)
+}
+
+// acceptBlock adds a block we received from a peer to the chain and relays it to our other peers as a compact block.
+func (pm *PeerManager) acceptBlock(from *Peer, block *Block) {
+	if err := pm.Chain.AddBlock(*block); err != nil {
+		if errors.Is(err, ErrInvalidBlock) {
+			pm.Misbehaving(from, OffenseInvalidBlock, err.Error())
+			return
+		}
+		// Our clocks may just disagree. Left unseen, the block can still come in again or through a sync
+		if errors.Is(err, ErrBlockFromFuture) {
+			Log(DEBUG, fmt.Sprintf("Dropped block %x from peer %s for now: %v", block.BlockHash, from.NodeID, err))
+			return
+		}
+		Log(WARNING, fmt.Sprintf("Rejected block %x from peer %s: %v", block.BlockHash, from.NodeID, err))
+
+		// A block from beyond our tip means the peer has blocks we are missing
+		if block.Height > pm.Chain.Height() {
+			from.setHeight(block.Height)
+			pm.requestSync(from)
+		}
+		return
+	}
+	pm.Seen.Add(block.BlockHash)
+	from.known.Add(block.BlockHash)
+	from.setHeight(block.Height)
+	Log(INFO, fmt.Sprintf("Accepted block %d (%x) from peer %s", block.Height, block.BlockHash, from.NodeID))
+
+	pm.relay(block.BlockHash, &Message{Type: MessageTypeCompactBlock, Compact: NewCompactBlock(block)})
+}
+
+// handleTransaction validates a gossiped transaction, adds it to the pending pool and relays it to our other peers.
+// Like a block, it is only marked as seen once it has been accepted.
+func (pm *PeerManager) handleTransaction(from *Peer, tx *Transaction) {
+	if tx == nil {
+		pm.Misbehaving(from, OffenseMalformedMessage, "transaction message without a transaction")
+		return
+	}
+	if pm.Seen.Has(tx.TxHash) {
+		from.known.Add(tx.TxHash)
+		return
+	}
+
+	if err := pm.Chain.AddTransaction(*tx); err != nil {
+		if errors.Is(err, ErrInvalidTransaction) {
+			pm.Misbehaving(from, OffenseInvalidTransaction, err.Error())
+			return
+		}
+		Log(WARNING, fmt.Sprintf("Rejected transaction %x from peer %s: %v", tx.TxHash, from.NodeID, err))
+		return
+	}
+	pm.Seen.Add(tx.TxHash)
+	from.known.Add(tx.TxHash)
+	Log(DEBUG, fmt.Sprintf("Accepted transaction %x from peer %s", tx.TxHash, from.NodeID))
+
+	// Once a transaction has been fluffed its stem is over, wherever it was fluffed
+	pm.Stem.take(tx.TxHash)
+	pm.announce(tx.TxHash)
+}
+
+// BroadcastBlock announces one of our own blocks to every peer as a compact block.
+func (pm *PeerManager) BroadcastBlock(block *Block) {
+	pm.Seen.Add(block.BlockHash)
+	pm.relay(block.BlockHash, &Message{Type: MessageTypeCompactBlock, Compact: NewCompactBlock(block)})
+}
+
+// BroadcastTransaction sends one of our own transactions along a stem of single peers before it is announced
+// to everyone, so that we don't look like its origin. With -nodandelion it is announced to every peer at once.
+func (pm *PeerManager) BroadcastTransaction(tx *Transaction) {
+	if noDandelion {
+		pm.fluff(tx)
+		return
+	}
+	pm.stem(nil, tx)
+}
+
+// relay sends message about hash to every active peer that doesn't already have hash.
+func (pm *PeerManager) relay(hash Hash, message *Message) {
+	for _, peer := range pm.Peers.List() {
+		if !peer.known.Add(hash) {
+			continue
+		}
+		if err := peer.sendMessage(message); err != nil {
+			Log(ERROR, fmt.Sprintf("Failed to relay message to peer %s: %v", peer.NodeID, err))
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
@@ -9,24 +10,52 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
 
 	initFlags()
+}
 
+// initNode does the setup only a running node needs, so that admin commands leave no trace and don't depend on it:
+// it opens the log file and checks the consensus flags, loading the genesis file, and the seeds file.
+func initNode() error {
 	// Open the log file
 	var err error
 	logFile, err = os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
-		log.Fatalf("failed to open log file: %v", err)
+		return fmt.Errorf("failed to open log file: %w", err)
 	}
 
 	// Set the log output to the file
 	log.SetOutput(logFile)
 	Log(DEBUG, "================== init ==================")
+
+	switch consensusMode {
+	case "signed", "pow":
+	case "poa":
+		if genesis, err = LoadGenesis(genesisFile); err != nil {
+			return fmt.Errorf("failed to load genesis file: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown consensus %q, expected signed, pow or poa", consensusMode)
+	}
+	if blockTime <= 0 {
+		return fmt.Errorf("block time must be positive, got %v", blockTime)
+	}
+	if seedsFileName != "" {
+		seeds, err := loadSeedsFile(seedsFileName)
+		if err != nil {
+			return fmt.Errorf("failed to load seeds file: %w", err)
+		}
+		bootstrapPeers = append(bootstrapPeers, seeds...)
+	}
+	return nil
 }
 
 func initFlags() {
@@ -41,14 +70,111 @@ func initFlags() {
 		return fmt.Errorf("invalid log level %q", s)
 	})
 	flag.IntVar(&port, "port", 19876, "Port number to listen on")
-	// Parse the flags
+	flag.Func("bootstrap", "Bootstrap peer as host:port (repeatable, or comma separated)", func(s string) error {
+		peers, err := parsePeerList(s)
+		bootstrapPeers = append(bootstrapPeers, peers...)
+		return err
+	})
+	flag.Func("static", "Peer as host:port to always stay connected to (repeatable, or comma separated)", func(s string) error {
+		peers, err := parsePeerList(s)
+		staticPeers = append(staticPeers, peers...)
+		return err
+	})
+	flag.StringVar(&seedsFileName, "seeds", "", "File listing bootstrap peers, one host:port per line")
+	flag.BoolVar(&noBootstrap, "nobootstrap", false, "Do not connect to bootstrap peers")
+	flag.IntVar(&maxOutbound, "maxoutbound", 8, "Number of outbound peer connections to maintain")
+	flag.IntVar(&maxInbound, "maxinbound", 64, "Maximum number of inbound peer connections")
+	flag.IntVar(&maxPerIP, "maxperip", 4, "Maximum number of inbound peer connections from a single IP")
+	flag.IntVar(&maxPerSubnet, "maxpersubnet", 8, "Maximum number of inbound peer connections from a single /16 (IPv4) or /32 (IPv6)")
+	flag.StringVar(&rpcAddress, "rpc", "127.0.0.1:19877", "Address for the local admin RPC server, empty to disable")
+	flag.DurationVar(&banDuration, "banduration", DefaultBanDurationHr*time.Hour, "How long misbehaving peers are banned for")
+	flag.Func("penalty", "Misbehavior points for an offense as name=points (invalidblock, invalidtx, badrecord, malformed)", func(s string) error {
+		name, value, found := strings.Cut(s, "=")
+		if !found {
+			return fmt.Errorf("expected name=points, got %q", s)
+		}
+		if _, exists := Penalties[Offense(name)]; !exists {
+			return fmt.Errorf("unknown offense %q", name)
+		}
+		points, err := strconv.Atoi(value)
+		if err != nil || points < 0 {
+			return fmt.Errorf("invalid points %q", value)
+		}
+		Penalties[Offense(name)] = points
+		return nil
+	})
+	flag.IntVar(&maxDownloadKB, "maxdownload", 0, "Total download cap in KB/s, 0 for no cap")
+	flag.IntVar(&maxUploadKB, "maxupload", 0, "Total upload cap in KB/s, 0 for no cap")
+	flag.IntVar(&peerDownloadKB, "peerdownload", 1024, "Download rate in KB/s a single peer may sustain before it is disconnected, 0 for no limit")
+	flag.Func("ratelimit", "Per-peer message rate limit as type=rate:burst, in messages per second (e.g. transaction=100:500)", func(s string) error {
+		name, value, found := strings.Cut(s, "=")
+		if !found {
+			return fmt.Errorf("expected type=rate:burst, got %q", s)
+		}
+		messageType, err := parseMessageType(name)
+		if err != nil {
+			return err
+		}
+		rateString, burstString, found := strings.Cut(value, ":")
+		if !found {
+			return fmt.Errorf("expected rate:burst, got %q", value)
+		}
+		rate, err := strconv.ParseFloat(rateString, 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid rate %q", rateString)
+		}
+		burst, err := strconv.ParseFloat(burstString, 64)
+		if err != nil || burst < 1 {
+			return fmt.Errorf("invalid burst %q", burstString)
+		}
+		MessageRateLimits[messageType] = RateLimit{Rate: rate, Burst: burst}
+		return nil
+	})
+	flag.Func("externaladdr", "Address to advertise to peers as host or host:port, instead of the one they see us at", func(s string) error {
+		if _, _, err := parseExternalAddress(s); err != nil {
+			return err
+		}
+		externalAddr = s
+		return nil
+	})
+	flag.BoolVar(&lightMode, "light", false, "Run as a light client that syncs headers only and verifies payments with proofs from full nodes")
+	flag.StringVar(&consensusMode, "consensus", "signed", "Consensus engine: signed (any key may issue blocks), pow (proof of work with the most-work chain winning forks) or poa (scheduled authorities from the genesis file)")
+	flag.StringVar(&genesisFile, "genesis", GenesisFilename, "Genesis file with the slot schedule and first authority set, under -consensus poa")
+	flag.DurationVar(&blockTime, "blocktime", DefaultBlockTime, "Block interval proof of work difficulty is retargeted towards")
+	flag.BoolVar(&mine, "mine", false, "Keep mining pending transactions into blocks")
+	flag.IntVar(&minerThreads, "minerthreads", runtime.NumCPU(), "Number of threads searching for a proof of work nonce")
+	flag.BoolVar(&noDHT, "nodht", false, "Do not run UDP peer discovery")
+	flag.BoolVar(&noDandelion, "nodandelion", false, "Broadcast our transactions to every peer at once instead of relaying them privately through one peer first")
+	flag.IntVar(&dhtPort, "dhtport", 0, "UDP port for peer discovery, 0 for the same port as -port")
+	flag.Func("dhtseed", "UDP discovery node as host:port to join the discovery network through (repeatable, or comma separated). Defaults to the bootstrap peers", func(s string) error {
+		seeds, err := parsePeerList(s)
+		dhtSeeds = append(dhtSeeds, seeds...)
+		return err
+	})
+	flag.StringVar(&configFileName, "config", "", "Config file with one \"flag: value\" per line")
+}
+
+// parseFlags parses the command line, then fills in any flag it didn't set from the config file.
+func parseFlags() error {
 	flag.Parse()
+
+	if configFileName != "" {
+		if err := loadConfigFile(configFileName); err != nil {
+			return fmt.Errorf("failed to load config file: %w", err)
+		}
+	}
+	return nil
 }
 
 func initChain() *Chain {
 	chain := &Chain{
 		FeeBasis:       10,
 		SuperBlockSize: 100,
+		Mutex:          new(sync.Mutex),
+		State:          make(map[PublicKey]*Account),
+		TxIndex:        make(map[Hash]uint64),
+		Consensus:      newConsensus(),
+		Side:           make(map[Hash]Block),
 	}
 	Log(DEBUG, "creating new blockchain")
 	Log(DEBUG, "FeeBasis "+strconv.Itoa(int(chain.FeeBasis)))
@@ -59,29 +185,41 @@ func initChain() *Chain {
 func generateDemoTXData(myKeys KeyPair, chain *Chain) error {
 	recipient, err := GenerateKeyPair()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to generate demo recipient: %w", err)
 	}
 
 	Log(DEBUG, "generating demo transactions..")
 	transactions, err := GenerateDemoTransactions(myKeys, *recipient, 500)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to generate demo transactions: %w", err)
 	}
 
 	for _, tx := range transactions {
 		err := chain.AddTransaction(tx)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("failed to add demo transaction: %w", err)
 		}
 
 	}
 
 	Log(DEBUG, "processing transactions..")
-	err = chain.MineBlock(myKeys.PrivateKey)
+	_, err = chain.MineBlock(context.Background(), myKeys.PrivateKey)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to mine demo block: %w", err)
+	}
+	return nil
+}
+
+// closeLog flushes our last message to the log file and closes it.
+func closeLog() {
+	if logFile == nil {
+		return
+	}
+	Log(DEBUG, "================== exit ==================")
+	log.SetOutput(os.Stderr)
+	if err := logFile.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to close log file: %v\n", err)
 	}
-	return err
 }
 
 func initKeypair() KeyPair {
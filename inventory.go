@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// announce queues a transaction hash for announcement to every active peer that doesn't already have it.
+func (pm *PeerManager) announce(hash Hash) {
+	for _, peer := range pm.Peers.List() {
+		if !peer.known.Add(hash) {
+			continue
+		}
+		peer.invMutex.Lock()
+		peer.invQueue = append(peer.invQueue, hash)
+		peer.invMutex.Unlock()
+	}
+}
+
+// announceInventory sends p the transaction hashes queued for it every InvInterval, for as long as it is connected.
+func (pm *PeerManager) announceInventory(p *Peer) {
+	ticker := time.NewTicker(InvInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			hashes := p.takeInventory(MaxInvBatch)
+			if len(hashes) == 0 {
+				break
+			}
+			if err := p.sendMessage(&Message{Type: MessageTypeInv, Inv: hashes}); err != nil {
+				Log(DEBUG, fmt.Sprintf("Failed to send inventory to peer %s: %v", p.NodeID, err))
+				return
+			}
+		}
+	}
+}
+
+// takeInventory removes and returns up to max hashes from the peer's announcement queue.
+func (p *Peer) takeInventory(max int) []Hash {
+	p.invMutex.Lock()
+	defer p.invMutex.Unlock()
+
+	n := len(p.invQueue)
+	if n > max {
+		n = max
+	}
+	hashes := p.invQueue[:n:n]
+	p.invQueue = p.invQueue[n:]
+	return hashes
+}
+
+// handleInv asks the peer for the announced transactions we don't have and haven't already asked another peer for.
+func (pm *PeerManager) handleInv(p *Peer, hashes []Hash) {
+	if len(hashes) == 0 || len(hashes) > MaxInvBatch {
+		pm.Misbehaving(p, OffenseMalformedMessage, fmt.Sprintf("Inv with %d hashes", len(hashes)))
+		return
+	}
+
+	wanted := make([]Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		p.known.Add(hash)
+
+		// A stem transaction we hold has been fluffed elsewhere, so we can fluff it too without fetching it
+		if tx, exists := pm.Stem.take(hash); exists {
+			pm.fluff(&tx)
+			continue
+		}
+		if pm.Seen.Has(hash) || !pm.Asked.Add(hash) {
+			continue
+		}
+		wanted = append(wanted, hash)
+	}
+	if len(wanted) == 0 {
+		return
+	}
+
+	if err := p.sendMessage(&Message{Type: MessageTypeGetData, Inv: wanted}); err != nil {
+		Log(DEBUG, fmt.Sprintf("Failed to send GetData to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// handleGetData sends the peer each requested transaction that is still in our pending pool.
+func (pm *PeerManager) handleGetData(p *Peer, hashes []Hash) {
+	if len(hashes) == 0 || len(hashes) > MaxInvBatch {
+		pm.Misbehaving(p, OffenseMalformedMessage, fmt.Sprintf("GetData with %d hashes", len(hashes)))
+		return
+	}
+
+	for _, hash := range hashes {
+		tx, exists := pm.Chain.PendingTransaction(hash)
+		if !exists {
+			continue
+		}
+		p.known.Add(hash)
+		if err := p.SendTransaction(&tx); err != nil {
+			Log(DEBUG, fmt.Sprintf("Failed to send transaction to peer %s: %v", p.NodeID, err))
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("shutting down")
+
+// startWorker runs f in the background as one of the loops Shutdown waits for.
+// f must return once pm.Context is cancelled.
+func (pm *PeerManager) startWorker(f func()) {
+	pm.workers.Add(1)
+	go func() {
+		defer pm.workers.Done()
+		f()
+	}()
+}
+
+// Listen accepts inbound peer connections on address until we shut down.
+// It only returns an error if we can't listen on address at all.
+func (pm *PeerManager) Listen(address string) error {
+	listener, err := pm.Network.Listen(address)
+	if err != nil {
+		return err
+	}
+	Log(INFO, fmt.Sprintf("listening for peers on %s", listener.Addr()))
+
+	pm.startWorker(func() {
+		<-pm.Context.Done()
+		listener.Close()
+	})
+	pm.startWorker(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if pm.Context.Err() != nil {
+					return
+				}
+				Log(ERROR, fmt.Sprintf("Failed to accept connection: %v", err))
+				continue
+			}
+
+			// Handle each connection in a new goroutine
+			go pm.handleConnection(conn)
+		}
+	})
+	return nil
+}
+
+// Shutdown stops accepting and dialing peers, disconnects from every peer, waits for our background
+// loops to finish and writes our state to disk. Each step is given ShutdownTimeout before we move on.
+func (pm *PeerManager) Shutdown() {
+	Log(INFO, "shutting down peer networking..")
+	pm.cancel()
+
+	// Once Context is cancelled no peer can be admitted, so this is every peer we will ever have
+	peers := pm.Peers.List()
+	for _, peer := range peers {
+		peer.Close()
+	}
+	waitFor("peer connections", func() {
+		for _, peer := range peers {
+			<-peer.Done()
+		}
+	})
+	waitFor("background tasks", pm.workers.Wait)
+
+	waitFor("state to be saved", func() {
+		if err := pm.Book.Save(); err != nil {
+			Log(ERROR, fmt.Sprintf("failed to save address book: %v", err))
+		}
+		if err := pm.Bans.Save(); err != nil {
+			Log(ERROR, fmt.Sprintf("failed to save ban list: %v", err))
+		}
+		if pm.Light != nil {
+			if err := pm.Light.Save(); err != nil {
+				Log(ERROR, fmt.Sprintf("failed to save headers: %v", err))
+			}
+		} else if err := pm.Chain.Save(ChainFilename); err != nil {
+			Log(ERROR, fmt.Sprintf("failed to save chain: %v", err))
+		}
+	})
+	Log(INFO, "peer networking stopped")
+}
+
+// waitFor runs wait and returns once it does, or after ShutdownTimeout if it hasn't by then.
+func waitFor(what string, wait func()) {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(ShutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		Log(WARNING, fmt.Sprintf("gave up waiting for %s after %v", what, ShutdownTimeout))
+	}
+}
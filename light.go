@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var ErrProofNotFound = errors.New("no peer could prove it")
+
+// NewLightChain creates an empty light chain that is saved to path.
+func NewLightChain(path string) *LightChain {
+	return &LightChain{Mutex: new(sync.Mutex), Path: path, Headers: make([]BlockHeader, 0)}
+}
+
+// LoadLightChain replays the headers saved in path onto a new light chain. A missing file gives an empty chain.
+func LoadLightChain(path string) (*LightChain, error) {
+	light := NewLightChain(path)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return light, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []BlockHeader
+	if err := json.Unmarshal(data, &headers); err != nil {
+		return nil, fmt.Errorf("failed to parse headers %s: %w", path, err)
+	}
+	for _, header := range headers {
+		if err := light.AddHeader(header); err != nil {
+			return nil, fmt.Errorf("failed to load header %d from %s: %w", header.Height, path, err)
+		}
+	}
+	return light, nil
+}
+
+// Save writes the headers to l.Path, replacing the previous copy atomically.
+func (l *LightChain) Save() error {
+	l.Mutex.Lock()
+	data, err := json.Marshal(l.Headers)
+	l.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := l.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.Path)
+}
+
+// AddHeader checks a header and adds it if it extends our tip. Headers that commit to a TxRoot are kept without their TxHashes.
+func (l *LightChain) AddHeader(header BlockHeader) error {
+	if err := header.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+
+	if header.Height != uint64(len(l.Headers)+1) {
+		return fmt.Errorf("header height %d does not extend chain at height %d", header.Height, len(l.Headers))
+	}
+	if header.ParentHash != l.tipHash() {
+		return errors.New("header parent does not match chain tip")
+	}
+
+	if header.Version >= BlockVersionMerkle {
+		header.TxHashes = nil
+	}
+	l.Headers = append(l.Headers, header)
+	return nil
+}
+
+// Height returns the height of our best header, or 0 for an empty chain.
+func (l *LightChain) Height() uint64 {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+
+	return uint64(len(l.Headers))
+}
+
+// Header returns our header at height.
+func (l *LightChain) Header(height uint64) (BlockHeader, bool) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+
+	if height < 1 || height > uint64(len(l.Headers)) {
+		return BlockHeader{}, false
+	}
+	return l.Headers[height-1], true
+}
+
+// Locator returns hashes of our headers for a peer to find the last block we have in common.
+func (l *LightChain) Locator() []Hash {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+
+	return buildLocator(len(l.Headers), func(i int) Hash { return l.Headers[i].BlockHash })
+}
+
+// tipHash returns the hash of our best header, or the zero hash for an empty chain. The caller must hold l.Mutex.
+func (l *LightChain) tipHash() Hash {
+	if len(l.Headers) == 0 {
+		return Hash{}
+	}
+	return l.Headers[len(l.Headers)-1].BlockHash
+}
+
+// height returns the height of our chain, whether we keep blocks or only headers.
+func (pm *PeerManager) height() uint64 {
+	if pm.Light != nil {
+		return pm.Light.Height()
+	}
+	return pm.Chain.Height()
+}
+
+// header returns the header of our block at height, whether we keep blocks or only headers.
+func (pm *PeerManager) header(height uint64) (BlockHeader, bool) {
+	if pm.Light != nil {
+		return pm.Light.Header(height)
+	}
+	return pm.Chain.Header(height)
+}
+
+// FullNode reports whether the peer stores the full chain and so can serve blocks and proofs.
+func (p *Peer) FullNode() bool {
+	record := p.CurrentRecord()
+	return record != nil && record.Services&ServiceFullNode != 0
+}
+
+// SyncLightChain brings our headers up to date with the fastest full node that is ahead of us.
+func (pm *PeerManager) SyncLightChain() {
+	failed := make(map[*Peer]bool)
+	for {
+		peer := pm.syncPeer(failed)
+		if peer == nil {
+			return
+		}
+
+		added, err := pm.syncLightHeaders(peer)
+		if err != nil {
+			Log(WARNING, fmt.Sprintf("header download from peer %s failed: %v", peer.NodeID, err))
+		}
+		if err != nil || added == 0 {
+			failed[peer] = true
+			continue
+		}
+		Log(INFO, fmt.Sprintf("caught up at height %d", pm.Light.Height()))
+	}
+}
+
+// syncLightHeaders adds the headers that follow our tip from p and returns how many it added.
+func (pm *PeerManager) syncLightHeaders(p *Peer) (int, error) {
+	locator := pm.Light.Locator()
+
+	added := 0
+	for {
+		batch, err := p.SendGetHeaders(&GetBlocksRequest{Locator: locator, Light: true})
+		if err != nil {
+			return added, err
+		}
+
+		for _, header := range batch {
+			if err := pm.Light.AddHeader(header); err != nil {
+				if errors.Is(err, ErrInvalidBlock) {
+					pm.Misbehaving(p, OffenseInvalidBlock, err.Error())
+				}
+				// We can't switch to a different chain, so there is nothing more to download from this peer
+				return added, fmt.Errorf("header %d: %w", header.Height, err)
+			}
+			added++
+			p.setHeight(header.Height)
+			locator = []Hash{header.BlockHash}
+		}
+
+		if len(batch) < MaxHeaders {
+			return added, nil
+		}
+		Log(INFO, fmt.Sprintf("downloaded headers up to %d from peer %s", pm.Light.Height(), p.NodeID))
+	}
+}
+
+// acceptHeader adds the header of a gossiped block to our light chain, or syncs if it shows the peer is ahead of us.
+func (pm *PeerManager) acceptHeader(from *Peer, header *BlockHeader) {
+	if err := pm.Light.AddHeader(*header); err != nil {
+		if errors.Is(err, ErrInvalidBlock) {
+			pm.Misbehaving(from, OffenseInvalidBlock, err.Error())
+			return
+		}
+		if header.Height > pm.Light.Height() {
+			from.setHeight(header.Height)
+			pm.requestSync(from)
+		}
+		return
+	}
+	pm.Seen.Add(header.BlockHash)
+	from.known.Add(header.BlockHash)
+	from.setHeight(header.Height)
+	Log(INFO, fmt.Sprintf("Accepted header %d (%x) from peer %s", header.Height, header.BlockHash, from.NodeID))
+}
+
+// handleGetTxProof answers with a proof that a transaction is on our chain, or with no proof if it isn't.
+func (pm *PeerManager) handleGetTxProof(p *Peer, message *Message) {
+	if message.Proof == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetTxProof without a body")
+		return
+	}
+
+	response := &Message{Type: MessageTypeTxProof}
+	if proof, exists := pm.Chain.TxProof(message.Proof.TxHash); exists {
+		response.TxProof = proof
+	}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send transaction proof to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// handleGetAccountProof answers with a proof of an account's state as of our tip, or with no proof if it has never been used.
+func (pm *PeerManager) handleGetAccountProof(p *Peer, message *Message) {
+	if message.Proof == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetAccountProof without a body")
+		return
+	}
+
+	response := &Message{Type: MessageTypeAccountProof}
+	if proof, exists := pm.Chain.AccountProof(message.Proof.Account); exists {
+		response.Account = proof
+	}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send account proof to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// SendGetTxProof asks the peer to prove that the transaction with hash is on its chain. It returns nil if the peer can't.
+func (p *Peer) SendGetTxProof(hash Hash) (*TxProof, error) {
+	response, err := p.Request(&Message{Type: MessageTypeGetTxProof, Proof: &ProofRequest{TxHash: hash}})
+	if err != nil {
+		return nil, err
+	}
+	if response.Type != MessageTypeTxProof {
+		return nil, fmt.Errorf("unexpected message type received: %v", response.Type)
+	}
+	return response.TxProof, nil
+}
+
+// SendGetAccountProof asks the peer to prove the state of the account with key. It returns nil if the peer can't.
+func (p *Peer) SendGetAccountProof(key PublicKey) (*AccountProof, error) {
+	response, err := p.Request(&Message{Type: MessageTypeGetAccountProof, Proof: &ProofRequest{Account: key}})
+	if err != nil {
+		return nil, err
+	}
+	if response.Type != MessageTypeAccountProof {
+		return nil, fmt.Errorf("unexpected message type received: %v", response.Type)
+	}
+	return response.Account, nil
+}
+
+// VerifyTransaction returns a proof that the transaction with hash is on our chain. A light client asks its
+// full node peers in turn and only returns a proof that checks out against its own headers.
+func (pm *PeerManager) VerifyTransaction(hash Hash) (*TxProof, error) {
+	if pm.Light == nil {
+		if proof, exists := pm.Chain.TxProof(hash); exists {
+			return proof, nil
+		}
+		return nil, ErrProofNotFound
+	}
+
+	err := ErrProofNotFound
+	for _, peer := range pm.PeersByLatency() {
+		if !peer.FullNode() {
+			continue
+		}
+		proof, requestErr := peer.SendGetTxProof(hash)
+		if requestErr != nil {
+			Log(DEBUG, fmt.Sprintf("failed to get transaction proof from peer %s: %v", peer.NodeID, requestErr))
+			continue
+		}
+		if proof == nil {
+			continue
+		}
+		if proof.Transaction.TxHash != hash {
+			pm.Misbehaving(peer, OffenseInvalidProof, "proof is for a different transaction")
+			continue
+		}
+		if err = pm.checkProof(peer, proof.Height, proof.BlockHash, proof.Verify); err == nil {
+			return proof, nil
+		}
+	}
+	return nil, err
+}
+
+// VerifyAccount returns a proof of the state of the account with key. A light client asks its full node
+// peers in turn and only returns a proof that checks out against its own headers.
+func (pm *PeerManager) VerifyAccount(key PublicKey) (*AccountProof, error) {
+	if pm.Light == nil {
+		if proof, exists := pm.Chain.AccountProof(key); exists {
+			return proof, nil
+		}
+		return nil, ErrProofNotFound
+	}
+
+	err := ErrProofNotFound
+	for _, peer := range pm.PeersByLatency() {
+		if !peer.FullNode() {
+			continue
+		}
+		proof, requestErr := peer.SendGetAccountProof(key)
+		if requestErr != nil {
+			Log(DEBUG, fmt.Sprintf("failed to get account proof from peer %s: %v", peer.NodeID, requestErr))
+			continue
+		}
+		if proof == nil {
+			continue
+		}
+		if proof.Account.Key != key {
+			pm.Misbehaving(peer, OffenseInvalidProof, "proof is for a different account")
+			continue
+		}
+		if err = pm.checkProof(peer, proof.Height, proof.BlockHash, proof.Verify); err == nil {
+			return proof, nil
+		}
+	}
+	return nil, err
+}
+
+// checkProof checks a proof from p against our header at height, penalizing p if the proof is wrong.
+// A proof for a block we don't have isn't held against the peer, since it may just be ahead of us.
+func (pm *PeerManager) checkProof(p *Peer, height uint64, blockHash Hash, verify func(*BlockHeader) error) error {
+	header, exists := pm.header(height)
+	if !exists {
+		pm.requestSync(p)
+		return fmt.Errorf("proof from peer %s is for block %d, which we haven't synced yet", p.NodeID, height)
+	}
+	if header.BlockHash != blockHash {
+		return fmt.Errorf("proof from peer %s is for block %x, which is not on our chain", p.NodeID, blockHash)
+	}
+	if err := verify(&header); err != nil {
+		pm.Misbehaving(p, OffenseInvalidProof, err.Error())
+		return fmt.Errorf("proof from peer %s is invalid: %w", p.NodeID, err)
+	}
+	return nil
+}
@@ -1,70 +1,111 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"net"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	if err := parseFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Admin commands talk to an already running node
+	if flag.NArg() > 0 {
+		os.Exit(runAdminCommand(flag.Args()))
+	}
+
+	// Run the node until we are asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := runNode(ctx)
+	stop()
+	if err != nil {
+		Log(CRITICAL, err.Error())
+	}
+
+	closeLog()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// runNode starts the node and keeps it running until ctx is cancelled, then shuts it down.
+func runNode(ctx context.Context) error {
+	if err := initNode(); err != nil {
+		return err
+	}
 
 	// Check that we have keys, or make them
 	myKeys := initKeypair()
 
-	// Create a new blockchain
-	chain := initChain()
+	// Load the blockchain we had last time we ran, or create a new one. A light client keeps only headers
+	var chain *Chain
+	var err error
+	if lightMode {
+		chain = initChain()
+	} else if chain, err = LoadChain(ChainFilename); err != nil {
+		Log(ERROR, fmt.Sprintf("failed to load chain, starting a new one: %v", err))
+		chain = initChain()
+	}
 
 	// Validate the blockchain
-	err := chain.Validate()
+	err = chain.Validate()
 	Log(DEBUG, "validating blockchain...")
 	if err != nil {
 		Log(CRITICAL, err.Error())
 	}
 
 	// Start the peer-to-peer network
-	peerManager := StartPeerNetwork(myKeys)
+	peerManager := StartPeerNetwork(myKeys, chain, TCPTransport{})
+	defer peerManager.Shutdown()
+
+	// Accept inbound peers until we shut down
+	if err := peerManager.Listen(fmt.Sprintf(":%d", port)); err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
 
 	// Discover new peers
 	peerManager.DiscoverPeers()
 
-	// Generate some demo transactions
-	err = generateDemoTXData(myKeys, chain)
-	if err != nil {
-		Log(ERROR, err.Error())
-	}
-
-	// Broadcast the first demo transaction to all peers
-	if len(chain.PendingTransactions) > 0 {
-		demoTx := &chain.PendingTransactions[0]
-		for _, peer := range peerManager.Peers {
-			if err := peer.SendTransaction(demoTx); err != nil {
-				Log(ERROR, fmt.Sprintf("Failed to send transaction to peer %s", peer.NodeID))
-			}
+	// Start the admin RPC server
+	if rpcAddress != "" {
+		server, err := StartRPCServer(rpcAddress, peerManager)
+		if err != nil {
+			Log(ERROR, fmt.Sprintf("admin RPC server failed: %v", err))
+		} else {
+			defer func() {
+				Log(INFO, "stopping admin RPC server..")
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+				defer cancel()
+				if err := server.Shutdown(shutdownCtx); err != nil {
+					Log(WARNING, fmt.Sprintf("admin RPC server did not stop cleanly: %v", err))
+				}
+			}()
 		}
 	}
 
-	Log(DEBUG, "blockchain loaded and validated")
-
-	// Start the listener in a new goroutine
-	go func() {
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	// Generate some demo transactions, unless we are a light client with no chain to put them in
+	if !lightMode {
+		err = generateDemoTXData(myKeys, chain)
 		if err != nil {
-			Log(ERROR, fmt.Sprintf("Failed to listen on port %d: %v", port, err))
-			os.Exit(1)
+			Log(ERROR, err.Error())
 		}
-		defer listener.Close()
+	}
 
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				Log(ERROR, fmt.Sprintf("Failed to accept connection: %v", err))
-				continue
-			}
+	// Announce the demo transactions to all peers
+	pending := chain.Pending()
+	for i := range pending {
+		peerManager.BroadcastTransaction(&pending[i])
+	}
 
-			// Handle each connection in a new goroutine
-			go handleConnection(conn)
-		}
-	}()
+	Log(DEBUG, "blockchain loaded and validated")
 
-	select {}
+	<-ctx.Done()
+	Log(INFO, "received shutdown signal")
+	return nil
 }
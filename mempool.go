@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// MempoolShortID returns the short ID of a pending transaction in a MempoolRequest with salt.
+func MempoolShortID(salt uint64, txHash Hash) uint64 {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, salt)
+	h.Write(txHash[:])
+	return binary.LittleEndian.Uint64(h.Sum(nil)) & ShortIDMask
+}
+
+// requestMempool asks a newly connected full node to announce the pending transactions we don't have.
+// We list the short IDs of our own pending pool so it can leave out what we already have, and the
+// announcements then go through the usual Inv and GetData exchange, which fetches each transaction
+// from only one peer however many we connect to at once.
+func (pm *PeerManager) requestMempool(p *Peer) {
+	if pm.Light != nil || !p.FullNode() {
+		return
+	}
+
+	var saltBytes [8]byte
+	if _, err := rand.Read(saltBytes[:]); err != nil {
+		Log(ERROR, fmt.Sprintf("failed to generate mempool salt: %v", err))
+		return
+	}
+	request := &MempoolRequest{Salt: binary.LittleEndian.Uint64(saltBytes[:]), ShortIDs: make([]uint64, 0)}
+	for _, tx := range pm.Chain.Pending() {
+		if len(request.ShortIDs) == MaxMempoolShortIDs {
+			break
+		}
+		request.ShortIDs = append(request.ShortIDs, MempoolShortID(request.Salt, tx.TxHash))
+	}
+
+	if err := p.sendMessage(&Message{Type: MessageTypeGetMempool, Mempool: request}); err != nil {
+		Log(DEBUG, fmt.Sprintf("Failed to ask peer %s for its mempool: %v", p.NodeID, err))
+	}
+}
+
+// handleGetMempool announces our pending transactions that the peer hasn't listed as having.
+// They are queued MempoolSyncRate a second, so the transactions the peer fetches in return stay
+// inside its rate limit however large our pool is.
+func (pm *PeerManager) handleGetMempool(p *Peer, message *Message) {
+	request := message.Mempool
+	if request == nil || len(request.ShortIDs) > MaxMempoolShortIDs {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetMempool without a body or with too many short IDs")
+		return
+	}
+
+	has := make(map[uint64]bool, len(request.ShortIDs))
+	for _, id := range request.ShortIDs {
+		has[id] = true
+	}
+
+	missing := make([]Hash, 0)
+	for _, tx := range pm.Chain.Pending() {
+		if has[MempoolShortID(request.Salt, tx.TxHash)] {
+			p.known.Add(tx.TxHash)
+			continue
+		}
+		if p.known.Add(tx.TxHash) {
+			missing = append(missing, tx.TxHash)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	Log(DEBUG, fmt.Sprintf("announcing %d pending transaction(s) to peer %s", len(missing), p.NodeID))
+	go announceBacklog(p, missing)
+}
+
+// announceBacklog queues hashes for announcement to p a batch every InvInterval, until all are queued or p disconnects.
+func announceBacklog(p *Peer, hashes []Hash) {
+	ticker := time.NewTicker(InvInterval)
+	defer ticker.Stop()
+
+	batch := int(MempoolSyncRate * InvInterval / time.Second)
+	for len(hashes) > 0 {
+		n := batch
+		if n > len(hashes) {
+			n = len(hashes)
+		}
+		p.invMutex.Lock()
+		p.invQueue = append(p.invQueue, hashes[:n]...)
+		p.invMutex.Unlock()
+		hashes = hashes[n:]
+
+		select {
+		case <-p.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
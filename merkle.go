@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// The Merkle trees follow RFC 6962: leaves and inner nodes are hashed with different prefixes so
+// that one can't pass for the other, and a tree of n leaves splits at the largest power of two below n.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+func merkleLeaf(leaf Hash) Hash {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, leaf[:]...))
+}
+
+func merkleNode(left, right Hash) Hash {
+	data := make([]byte, 0, 1+2*len(left))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+	return sha256.Sum256(data)
+}
+
+// merkleSplit returns the largest power of two smaller than n, for n > 1.
+func merkleSplit(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+// MerkleRoot returns the root of the Merkle tree over leaves.
+func MerkleRoot(leaves []Hash) Hash {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return merkleLeaf(leaves[0])
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNode(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// MerkleBranch returns the hashes that prove leaves[index] is in the tree, from the leaf up.
+func MerkleBranch(leaves []Hash, index int) []Hash {
+	if len(leaves) <= 1 {
+		return []Hash{}
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(MerkleBranch(leaves[:k], index), MerkleRoot(leaves[k:]))
+	}
+	return append(MerkleBranch(leaves[k:], index-k), MerkleRoot(leaves[:k]))
+}
+
+// VerifyMerkleBranch reports whether branch proves that leaf is at index in the tree of count leaves with root.
+func VerifyMerkleBranch(leaf Hash, index, count uint64, branch []Hash, root Hash) bool {
+	if index >= count {
+		return false
+	}
+
+	// This walks up the tree as described in RFC 9162, section 2.1.3.2
+	fn, sn := index, count-1
+	hash := merkleLeaf(leaf)
+	for _, sibling := range branch {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = merkleNode(sibling, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = merkleNode(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && hash == root
+}
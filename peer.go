@@ -1,9 +1,11 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -11,180 +13,495 @@ import (
 	"time"
 )
 
-func (pl *PeerList) InitializePeers(peerParams []struct {
-	NodeID    NodeID
-	Address   net.IP
-	Port      uint16
-	PublicKey PublicKey
-}) {
-	for _, param := range peerParams {
-		pl.Peers[param.NodeID] = &Peer{
-			NodeID:    param.NodeID,
-			Address:   param.Address,
-			Port:      param.Port,
-			PublicKey: param.PublicKey,
-		}
+// NodeIDFromKey derives a node's NodeID from its public key, so that a NodeID can't be claimed without the key.
+func NodeIDFromKey(key PublicKey) NodeID {
+	h := sha256.Sum256(key[:])
+	return NodeID(hex.EncodeToString(h[:16]))
+}
+
+func NewPeerManager(myNode *Peer, keys KeyPair, chain *Chain, book *AddressBook, bans *BanList, network Transport) *PeerManager {
+	Log(DEBUG, "starting peer manager..")
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PeerManager{
+		Peers:   NewPeerRegistry(),
+		Mutex:   &sync.Mutex{},
+		MyNode:  myNode,
+		Keys:    keys,
+		Chain:   chain,
+		Seen:    NewSeenCache(SeenCacheTTL),
+		Asked:   NewSeenCache(GetDataExpiry),
+		Book:    book,
+		Dialing: make(map[string]bool),
+		FromIP:  make(map[string]int),
+		FromNet: make(map[string]int),
+		Bans:    bans,
+		Limits:  NewGlobalLimits(),
+		Metrics: NewMetrics(),
+		Sync:    NewSyncState(),
+		Address: NewAddressVotes(),
+		Stem:    NewDandelionState(),
+		Context: ctx,
+		Network: network,
+		cancel:  cancel,
 	}
 }
 
-// Generate a random NodeID
-func GenerateNodeID() NodeID {
-	b := make([]byte, 16)
-	rand.Read(b)
-	Log(DEBUG, "nodeID: "+hex.EncodeToString(b))
-	return NodeID(hex.EncodeToString(b))
+func (t MessageType) String() string {
+	if name, exists := messageTypeNames[t]; exists {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
 }
 
-func NewPeerList() *PeerList {
-	Log(DEBUG, "creating new peer list..")
-	return &PeerList{
-		Peers: make(map[NodeID]*Peer),
+// handleConnection serves an inbound connection until it is closed.
+func (pm *PeerManager) handleConnection(conn net.Conn) {
+	peer := &Peer{Inbound: true}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer.Address = addr.IP
+	}
+	if pm.Bans.IsBanned(peer.Address) {
+		Log(DEBUG, fmt.Sprintf("Refusing connection from banned address %s", peer.Address))
+		conn.Close()
+		return
 	}
+	release, err := pm.reserveInbound(peer.Address)
+	if err != nil {
+		Log(DEBUG, fmt.Sprintf("Refusing connection from %s: %v", peer.Address, err))
+		conn.Close()
+		return
+	}
+	defer release()
+
+	peer.Limits = NewPeerLimits()
+	peer.attach(pm.meter(conn, peer.Limits), pm.handleMessage)
+	pm.servePeer(peer)
 }
 
-func NewPeerManager(myNode *Peer) *PeerManager {
-	Log(DEBUG, "starting peer manager..")
-	return &PeerManager{
-		Peers:  make(map[NodeID]*Peer),
-		Mutex:  &sync.Mutex{},
-		MyNode: myNode,
+// servePeer runs the peer's read loop until the connection closes, penalizing the peer if it sent us garbage.
+func (pm *PeerManager) servePeer(p *Peer) {
+	err := p.readLoop()
+
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxError) || errors.As(err, &typeError):
+		pm.Misbehaving(p, OffenseMalformedMessage, err.Error())
+	case errors.Is(err, ErrPeerBandwidthExceeded):
+		pm.Metrics.Mutex.Lock()
+		pm.Metrics.BandwidthDisconnects++
+		pm.Metrics.Mutex.Unlock()
+		Log(WARNING, fmt.Sprintf("disconnected peer %s (%s): %v", p.NodeID, p.Address, err))
 	}
 }
 
-func handleConnection(conn net.Conn) {
-	decoder := json.NewDecoder(conn)
-	for {
-		var message Message
-		err := decoder.Decode(&message)
-		if err != nil {
-			Log(ERROR, fmt.Sprintf("Failed to decode message from peer: %v", err))
-			break
-		}
+// handleMessage handles messages from a peer that are not responses to our own requests.
+func (pm *PeerManager) handleMessage(p *Peer, message *Message) {
+	if !pm.allowMessage(p, message) {
+		return
+	}
 
-		switch message.Type {
-		case MessageTypeHelloRequest:
-			// If we received a HelloRequest, verify the peer's public key (add this functionality)
-			// For this example, we're assuming all HelloRequest messages have valid keys and NodeID
+	switch message.Type {
+	case MessageTypeHelloRequest:
+		pm.handleHelloRequest(p, message)
+	case MessageTypeDiscoverPeersRequest:
+		pm.handleDiscoverPeersRequest(p, message)
+	case MessageTypePing:
+		pm.handlePing(p, message)
+	case MessageTypeGetBlocks:
+		pm.handleGetBlocks(p, message)
+	case MessageTypeGetHeaders:
+		pm.handleGetHeaders(p, message)
+	case MessageTypeCompactBlock:
+		pm.handleCompactBlock(p, message.Compact)
+	case MessageTypeGetBlockTxs:
+		pm.handleGetBlockTxs(p, message)
+	case MessageTypeInv:
+		pm.handleInv(p, message.Inv)
+	case MessageTypeGetData:
+		pm.handleGetData(p, message.Inv)
+	case MessageTypePeerRecord:
+		pm.handlePeerRecord(p, message.Record)
+	case MessageTypeBlock:
+		pm.handleBlock(p, message.Block)
+	case MessageTypeTransaction:
+		pm.handleTransaction(p, message.Transaction)
+	case MessageTypeStemTransaction:
+		pm.handleStemTransaction(p, message.Transaction)
+	case MessageTypeGetMempool:
+		pm.handleGetMempool(p, message)
+	case MessageTypeGetTxProof:
+		pm.handleGetTxProof(p, message)
+	case MessageTypeGetAccountProof:
+		pm.handleGetAccountProof(p, message)
+	case MessageTypeGetFilters:
+		pm.handleGetFilters(p, message)
+	case MessageTypeGetFilterHeaders:
+		pm.handleGetFilterHeaders(p, message)
+	default:
+		// If we received a different message type, log a message and do nothing
+		Log(WARNING, fmt.Sprintf("Received unexpected message type %v from peer %s", message.Type, p.NodeID))
+	}
+}
 
-			// Create a new peer and add it to the GlobalPeers map
-			newPeer := &Peer{
-				NodeID:    message.HelloReq.NodeID,
-				PublicKey: message.HelloReq.PublicKey,
-				Conn:      conn,
-			}
-			GlobalPeers[newPeer.NodeID] = newPeer
+// handleHelloRequest checks an inbound peer's signed record, answers with our own record and registers the peer.
+// We answer even if we then refuse the peer, so that a dialer can tell it reached itself or a peer it is already connected to.
+func (pm *PeerManager) handleHelloRequest(p *Peer, message *Message) {
+	hello := message.HelloReq
+	if hello == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "HelloRequest without a body")
+		p.Close()
+		return
+	}
+	if err := hello.Record.Verify(hello.NodeID, hello.PublicKey); err != nil {
+		pm.Misbehaving(p, OffenseBadRecord, err.Error())
+		p.Close()
+		return
+	}
 
-			// Generate a HelloResponse and send it back
-			response := &HelloResponse{
-				NodeID:    MyNodeID,
-				PublicKey: MyPublicKey,
-			}
-			respMessage := &Message{
-				Type:     MessageTypeHelloResponse,
-				HelloRes: response,
-			}
-			encoder := json.NewEncoder(conn)
-			err = encoder.Encode(respMessage)
-			if err != nil {
-				Log(ERROR, fmt.Sprintf("Failed to send HelloResponse to peer: %v", err))
-			}
-		default:
-			// If we received a different message type, log a message and do nothing
-			// Log(INFO, fmt.Sprintf("Received unexpected message type: %v", message.Type))
-			Log(WARNING, fmt.Sprintf("Received unexpected message type: %v", message))
-		}
+	p.NodeID = hello.NodeID
+	p.PublicKey = hello.PublicKey
+	p.Record = hello.Record
+	p.Port = hello.Record.Port
+	p.setHeight(hello.Height)
+
+	// Generate a HelloResponse and send it back
+	record, err := pm.MyRecord()
+	if err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to sign our peer record: %v", err))
+		return
+	}
+	response := &Message{
+		Type: MessageTypeHelloResponse,
+		HelloRes: &HelloResponse{
+			NodeID:      pm.MyNode.NodeID,
+			PublicKey:   pm.MyNode.PublicKey,
+			Record:      record,
+			Height:      pm.height(),
+			YourAddress: p.Address,
+		},
+	}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send HelloResponse to peer: %v", err))
+		p.Close()
+		return
 	}
 
-	conn.Close()
+	if err := pm.admitPeer(p); err != nil {
+		Log(DEBUG, fmt.Sprintf("Refusing inbound peer %s: %v", p.NodeID, err))
+		p.Close()
+		return
+	}
+	if hello.Record.Address == nil {
+		pm.Book.AddObserved(*hello.Record, p.Address, p.Address)
+	} else {
+		pm.Book.Add(*hello.Record, p.Address)
+	}
+	pm.requestSync(p)
 }
 
-func StartPeerNetwork(myKeys KeyPair) *PeerManager {
+func StartPeerNetwork(myKeys KeyPair, chain *Chain, network Transport) *PeerManager {
 	// Instantiate our PeerManager and our own Peer
 	Log(DEBUG, "starting peer networking..")
 	myNode := &Peer{
-		NodeID:    GenerateNodeID(),
+		NodeID:    NodeIDFromKey(myKeys.PublicKey),
 		PublicKey: myKeys.PublicKey,
-		// fill in Address and Port fields
+		Port:      uint16(port),
 	}
 
 	MyNodeID = myNode.NodeID
+	Log(DEBUG, "nodeID: "+string(myNode.NodeID))
 	MyPublicKey = myNode.PublicKey
+	// Load the peers we knew about last time we ran
+	book, err := LoadAddressBook(AddressBookFilename)
+	if err != nil {
+		Log(ERROR, fmt.Sprintf("failed to load address book, starting a new one: %v", err))
+		book = NewAddressBook(AddressBookFilename)
+	}
+
+	bans, err := LoadBanList(BanListFilename)
+	if err != nil {
+		Log(ERROR, fmt.Sprintf("failed to load ban list, starting a new one: %v", err))
+		bans = NewBanList(BanListFilename)
+	}
+
 	// Initialize the PeerManager with our node
-	peerManager := &PeerManager{
-		Peers:  make(map[NodeID]*Peer),
-		Mutex:  new(sync.Mutex),
-		MyNode: myNode,
+	peerManager := NewPeerManager(myNode, myKeys, chain, book, bans, network)
+	if lightMode {
+		light, err := LoadLightChain(HeadersFilename)
+		if err != nil {
+			Log(ERROR, fmt.Sprintf("failed to load headers, starting over: %v", err))
+			light = NewLightChain(HeadersFilename)
+		}
+		peerManager.Light = light
+	}
+	if externalAddr != "" {
+		if err := peerManager.SetExternalAddress(externalAddr); err != nil {
+			Log(ERROR, fmt.Sprintf("failed to set external address: %v", err))
+		}
 	}
+	peerManager.startWorker(func() { book.SaveEvery(peerManager.Context, AddressBookSaveInterval) })
 
-	// Hardcoded bootstrap peers
-	bootstrapPeers := []struct {
-		ip   string
-		port uint16
-	}{
-		{"170.64.168.154", 19876},
-		{"159.65.11.179", 19876},
-		{"165.22.9.57", 19876},
+	// Join the UDP discovery network
+	if !noDHT {
+		if dhtPort == 0 {
+			dhtPort = port
+		}
+		if err := peerManager.StartDHT(fmt.Sprintf(":%d", dhtPort), discoverySeeds()); err != nil {
+			Log(ERROR, fmt.Sprintf("failed to start peer discovery: %v", err))
+		}
+	}
+
+	// Static peers are kept connected for as long as we run
+	for _, address := range staticPeers {
+		address := address
+		peerManager.startWorker(func() { peerManager.KeepConnected(address) })
+	}
+
+	// Reconnect to the peers we were connected to longest last time, then to the best peers from our address book
+	peerManager.ConnectToAnchors(AnchorsFilename)
+	peerManager.startWorker(func() { peerManager.RunAnchors(AnchorsFilename) })
+	peerManager.ConnectToKnownPeers(peerManager.freeOutboundSlots())
+	if peerManager.PeerCount() == 0 {
+		peerManager.Bootstrap()
+	}
+
+	// Discover new peers
+	peerManager.DiscoverPeers()
+
+	// Keep our outbound slots filled from now on
+	peerManager.startWorker(peerManager.RunConnectionManager)
+
+	// Fluff the stem transactions that were dropped on their way
+	peerManager.startWorker(peerManager.RunDandelion)
+
+	// Download the blocks or headers we are missing, now and whenever a peer gets ahead of us
+	peerManager.startWorker(peerManager.RunSync)
+
+	// Mine our pending transactions into blocks
+	if mine && !lightMode {
+		peerManager.startWorker(peerManager.RunMiner)
+	}
+
+	return peerManager
+}
+
+// discoverySeeds returns the configured discovery seeds. Without any we try our bootstrap peers,
+// since a node's discovery service runs on the same port as its peer connections by default.
+func discoverySeeds() []string {
+	switch {
+	case len(dhtSeeds) > 0:
+		return dhtSeeds
+	case noBootstrap:
+		return nil
+	case len(bootstrapPeers) > 0:
+		return bootstrapPeers
+	}
+	return DefaultBootstrapPeers
+}
+
+// Bootstrap connects to the configured bootstrap peers, or to DefaultBootstrapPeers if none are configured.
+func (pm *PeerManager) Bootstrap() {
+	if noBootstrap {
+		Log(INFO, "outbound bootstrapping is disabled")
+		return
+	}
+
+	peers := bootstrapPeers
+	if len(peers) == 0 {
+		peers = DefaultBootstrapPeers
 	}
 
 	// Use a WaitGroup to wait for all connection attempts to finish
 	var wg sync.WaitGroup
 
-	for _, info := range bootstrapPeers {
+	for _, address := range peers {
 		wg.Add(1)
-		go func(info struct {
-			ip   string
-			port uint16
-		}) { // Launch a goroutine for each peer
+		go func(address string) { // Launch a goroutine for each peer
 			defer wg.Done()
-			peer := &Peer{
-				Address: net.ParseIP(info.ip),
-				Port:    info.port,
-			}
-			if err := peer.Connect(peerManager); err != nil {
-				Log(ERROR, fmt.Sprintf("failed to connect to peer %s:%d", info.ip, info.port))
+			ip, peerPort, err := ResolvePeerAddress(address)
+			if err != nil {
+				Log(ERROR, fmt.Sprintf("failed to resolve bootstrap peer %s: %v", address, err))
 				return
 			}
+			if _, err := pm.ConnectToPeer(ip, peerPort); err != nil {
+				Log(ERROR, fmt.Sprintf("failed to connect to peer %s: %v", address, err))
+			}
+		}(address)
+	}
 
-			// Exchange HelloRequest and HelloResponse to get NodeID
-			helloRequest := &HelloRequest{
-				NodeID:    myNode.NodeID,
-				PublicKey: myNode.PublicKey,
+	wg.Wait() // Wait for all goroutines to finish
+}
+
+// KeepConnected stays connected to the peer at address, redialing with backoff whenever the connection drops,
+// until we shut down.
+func (pm *PeerManager) KeepConnected(address string) {
+	backoff := ReconnectBackoffBase
+	for pm.Context.Err() == nil {
+		ip, peerPort, err := ResolvePeerAddress(address)
+		if err == nil {
+			var peer *Peer
+			peer, err = pm.ConnectToPeer(ip, peerPort)
+			if err == nil {
+				Log(INFO, fmt.Sprintf("connected to static peer %s", address))
+				backoff = ReconnectBackoffBase
+				<-peer.Done()
+				Log(INFO, fmt.Sprintf("lost connection to static peer %s", address))
+				continue
 			}
-			helloResponse, err := peer.SendHelloRequest(helloRequest)
-			if err != nil {
-				Log(ERROR, fmt.Sprintf("failed to send HelloRequest to peer %s:%d", info.ip, info.port))
-				return
+		}
+
+		Log(WARNING, fmt.Sprintf("failed to connect to static peer %s, retrying in %v: %v", address, backoff, err))
+		select {
+		case <-pm.Context.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > ReconnectBackoffMax {
+			backoff = ReconnectBackoffMax
+		}
+	}
+}
+
+// ConnectToKnownPeers dials up to n of the best addresses from our address book in parallel,
+// skipping addresses we are already connected or connecting to and network groups we already have an outbound peer in.
+func (pm *PeerManager) ConnectToKnownPeers(n int) {
+	candidates := pm.outboundCandidates(n)
+
+	var wg sync.WaitGroup
+	for _, candidate := range candidates {
+		wg.Add(1)
+		go func(entry AddressEntry) {
+			defer wg.Done()
+			if _, err := pm.ConnectToPeer(entry.Address, entry.Port); err != nil {
+				Log(DEBUG, fmt.Sprintf("failed to reconnect to %s: %v", AddressKey(entry.Address, entry.Port), err))
 			}
+		}(candidate)
+	}
+	wg.Wait()
+}
+
+// ConnectToPeer dials a peer, performs the hello handshake and adds it to our active peers.
+// The outcome is recorded in the address book.
+func (pm *PeerManager) ConnectToPeer(address net.IP, port uint16) (*Peer, error) {
+	key := AddressKey(address, port)
+	if !pm.reserveDial(key) {
+		return nil, fmt.Errorf("already dialing %s", key)
+	}
+	defer pm.releaseDial(key)
 
-			// After successfully getting HelloResponse, set NodeID and PublicKey
-			peer.NodeID = helloResponse.NodeID
-			peer.PublicKey = helloResponse.PublicKey
+	return pm.connectToReserved(address, port)
+}
+
+// reserveDial marks the address with key as being dialed, which takes up one of our outbound slots
+// until releaseDial. It returns false if the address is already being dialed.
+func (pm *PeerManager) reserveDial(key string) bool {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
 
-			// Add to PeerManager's peers
-			peerManager.AddPeer(peer)
-		}(info)
+	if pm.Dialing[key] {
+		return false
 	}
+	pm.Dialing[key] = true
+	return true
+}
 
-	wg.Wait() // Wait for all goroutines to finish
+// releaseDial frees the outbound slot taken by reserveDial.
+func (pm *PeerManager) releaseDial(key string) {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
 
-	// Discover new peers
-	peerManager.DiscoverPeers()
+	delete(pm.Dialing, key)
+}
 
-	return peerManager
+// connectToReserved is ConnectToPeer for an address the caller has reserved with reserveDial.
+func (pm *PeerManager) connectToReserved(address net.IP, port uint16) (*Peer, error) {
+	if pm.Context.Err() != nil {
+		return nil, ErrShuttingDown
+	}
+	if pm.Bans.IsBanned(address) {
+		return nil, fmt.Errorf("%s is banned", address)
+	}
+
+	pm.Book.MarkAttempt(address, port)
+	peer, err := pm.connectToPeer(address, port)
+	switch {
+	case errors.Is(err, ErrSelfConnection):
+		// This address is us, so never dial it again
+		pm.Book.Remove(address, port)
+		return nil, err
+	case errors.Is(err, ErrDuplicatePeer):
+		// The address works, we just already have a connection to it
+		pm.Book.MarkSuccess(address, port, "", nil)
+		return nil, err
+	case err != nil:
+		pm.Book.MarkFailure(address, port)
+		return nil, err
+	}
+	pm.Book.MarkSuccess(address, port, peer.NodeID, peer.CurrentRecord())
+	return peer, nil
+}
+
+func (pm *PeerManager) connectToPeer(address net.IP, port uint16) (*Peer, error) {
+	peer := &Peer{
+		Address: address,
+		Port:    port,
+	}
+	if err := peer.Connect(pm); err != nil {
+		return nil, err
+	}
+
+	// Exchange HelloRequest and HelloResponse to get NodeID
+	record, err := pm.MyRecord()
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	helloRequest := &HelloRequest{
+		NodeID:      pm.MyNode.NodeID,
+		PublicKey:   pm.MyNode.PublicKey,
+		Record:      record,
+		Height:      pm.height(),
+		YourAddress: address,
+	}
+	helloResponse, err := peer.SendHelloRequest(helloRequest)
+	if err != nil {
+		peer.Close()
+		return nil, fmt.Errorf("hello failed: %w", err)
+	}
+	if err := helloResponse.Record.Verify(helloResponse.NodeID, helloResponse.PublicKey); err != nil {
+		pm.Misbehaving(peer, OffenseBadRecord, err.Error())
+		peer.Close()
+		return nil, fmt.Errorf("invalid hello response: %w", err)
+	}
+
+	// After successfully getting HelloResponse, set NodeID and PublicKey
+	peer.NodeID = helloResponse.NodeID
+	peer.PublicKey = helloResponse.PublicKey
+	peer.Record = helloResponse.Record
+	peer.setHeight(helloResponse.Height)
+
+	// Add to PeerManager's peers and start handling its messages
+	if err := pm.admitPeer(peer); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	go pm.servePeer(peer)
+	pm.VoteAddress(peer.Address, helloResponse.YourAddress)
+	pm.requestSync(peer)
+	return peer, nil
 }
 
 // Establishes a connection to the peer.
 func (p *Peer) Connect(pm *PeerManager) error {
 	address := net.JoinHostPort(p.Address.String(), strconv.Itoa(int(p.Port)))
-	conn, err := net.Dial("tcp", address)
+	conn, err := pm.Network.Dial(address, RequestTimeout)
 	if err != nil {
 		return err
 	}
 
-	p.Conn = conn
-
-	// Add the connected peer to the PeerManager
-	pm.AddPeer(p)
+	// The read loop is started once the hello handshake has completed
+	p.Limits = NewPeerLimits()
+	p.attach(pm.meter(conn, p.Limits), pm.handleMessage)
 
 	return nil
 }
@@ -213,13 +530,7 @@ func (p *Peer) SendDiscoverPeersRequest(request *DiscoverPeersRequest) (*Discove
 		Type:    MessageTypeDiscoverPeersRequest,
 		Request: request,
 	}
-	err := p.sendMessage(&message)
-	if err != nil {
-		return nil, err
-	}
-
-	// Assuming we get a response immediately after a request
-	responseMessage, err := p.receiveMessage()
+	responseMessage, err := p.Request(&message)
 	if err != nil {
 		return nil, err
 	}
@@ -232,110 +543,212 @@ func (p *Peer) SendDiscoverPeersRequest(request *DiscoverPeersRequest) (*Discove
 	return responseMessage.Response, nil
 }
 
+// sendMessage writes message to the peer. A peer we cannot write to is treated as dead and closed.
 func (p *Peer) sendMessage(message *Message) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	if err := p.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout)); err != nil {
+		p.Close()
+		return err
+	}
 	encoder := json.NewEncoder(p.Conn)
-	return encoder.Encode(message)
+	if err := encoder.Encode(message); err != nil {
+		p.Close()
+		return err
+	}
+	return nil
 }
 
-func (p *Peer) receiveMessage() (*Message, error) {
-	// Set a deadline on the connection for the read operation
-	deadline := time.Now().Add(2 * time.Second)
-	err := p.Conn.SetReadDeadline(deadline)
-	if err != nil {
-		return nil, err
-	}
+// attach binds conn to the peer and prepares it for request/response correlation.
+func (p *Peer) attach(conn net.Conn, handler MessageHandler) {
+	p.Conn = conn
+	p.decoder = json.NewDecoder(conn)
+	p.Handler = handler
+	p.pending = make(map[uint64]chan *Message)
+	p.done = make(chan struct{})
+	p.lastReceived = time.Now()
+	p.known = NewSeenCache(SeenCacheTTL)
+}
 
-	decoder := json.NewDecoder(p.Conn)
-	var message Message
-	err = decoder.Decode(&message)
-	if err != nil {
-		// If the deadline was exceeded, return a custom error message
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return nil, fmt.Errorf("receiveMessage: timeout")
+// readLoop is the only reader of the peer's connection. Responses are routed to
+// the caller waiting on the matching request and everything else goes to Handler.
+// It closes the peer and returns the read error when the connection fails.
+func (p *Peer) readLoop() error {
+	defer p.Close()
+
+	for {
+		var message Message
+		err := p.decoder.Decode(&message)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				Log(ERROR, fmt.Sprintf("Failed to decode message from peer %s: %v", p.NodeID, err))
+			}
+			return err
 		}
-		return nil, err
-	}
-	return &message, nil
-}
 
-// AddPeer Adds a new peer to the peer list.
-func (pm *PeerManager) AddPeer(peer *Peer) {
-	pm.Mutex.Lock()
-	defer pm.Mutex.Unlock()
+		// Don't act on anything still buffered once the peer has been closed
+		select {
+		case <-p.done:
+			return nil
+		default:
+		}
+		p.markReceived()
 
-	if _, exists := pm.Peers[peer.NodeID]; !exists {
-		pm.Peers[peer.NodeID] = peer
+		if message.ResponseTo != 0 {
+			p.deliverResponse(&message)
+			continue
+		}
+
+		if p.Handler != nil {
+			p.Handler(p, &message)
+		}
 	}
 }
 
-// RemovePeer Removes a peer from the peer list.
-func (pm *PeerManager) RemovePeer(nodeID NodeID) {
-	pm.Mutex.Lock()
-	defer pm.Mutex.Unlock()
-
-	delete(pm.Peers, nodeID)
-}
+// deliverResponse hands a response to the caller waiting on it, if there still is one.
+func (p *Peer) deliverResponse(message *Message) {
+	p.pendingMutex.Lock()
+	waiter, exists := p.pending[message.ResponseTo]
+	delete(p.pending, message.ResponseTo)
+	p.pendingMutex.Unlock()
 
-func NodeIDToPeer(nodeID NodeID) (*Peer, error) {
-	peer, exists := GlobalPeers[nodeID]
 	if !exists {
-		return nil, fmt.Errorf("peer with NodeID %s not found", nodeID)
+		Log(WARNING, fmt.Sprintf("Dropping response %d from peer %s: no request is waiting for it", message.ResponseTo, p.NodeID))
+		return
 	}
-
-	return peer, nil
+	waiter <- message
 }
 
-// Discovers new peers by sending a DiscoverPeersRequest to all known peers
-func (pm *PeerManager) DiscoverPeers() {
-	Log(DEBUG, "discovering new peers..")
+// Request sends message to the peer and waits for the response carrying its RequestID.
+// It gives up after RequestTimeout or when the connection is closed.
+func (p *Peer) Request(message *Message) (*Message, error) {
+	waiter := make(chan *Message, 1)
 
-	pm.Mutex.Lock()
-	defer pm.Mutex.Unlock()
+	p.pendingMutex.Lock()
+	p.nextRequestID++
+	message.RequestID = p.nextRequestID
+	p.pending[message.RequestID] = waiter
+	p.pendingMutex.Unlock()
 
-	knownPeers := make([]NodeID, 0, len(pm.Peers))
-	for nodeID := range pm.Peers {
-		Log(DEBUG, "adding peer: "+string(nodeID))
-		knownPeers = append(knownPeers, nodeID)
+	defer func() {
+		p.pendingMutex.Lock()
+		delete(p.pending, message.RequestID)
+		p.pendingMutex.Unlock()
+	}()
+
+	if err := p.sendMessage(message); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-waiter:
+		return response, nil
+	case <-p.done:
+		// The response may have arrived just before the connection closed
+		select {
+		case response := <-waiter:
+			return response, nil
+		default:
+		}
+		return nil, fmt.Errorf("connection to peer %s closed while waiting for response", p.NodeID)
+	case <-timer.C:
+		return nil, fmt.Errorf("request %d to peer %s timed out", message.RequestID, p.NodeID)
 	}
+}
 
-	request := &DiscoverPeersRequest{KnownPeers: knownPeers}
+// Reply sends response to the peer as the answer to request.
+func (p *Peer) Reply(request *Message, response *Message) error {
+	response.ResponseTo = request.RequestID
+	return p.sendMessage(response)
+}
 
-	for _, peer := range pm.Peers {
-		response, err := peer.SendDiscoverPeersRequest(request)
-		if err != nil {
-			continue
+// Done returns a channel that is closed once the peer's connection has been shut down.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Close shuts down the peer's connection and releases any callers waiting on a response.
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		if p.done != nil {
+			close(p.done)
+		}
+		if p.Conn != nil {
+			p.Conn.Close()
 		}
+	})
+}
 
-		for _, nodeID := range response.Peers {
-			if _, exists := pm.Peers[nodeID]; !exists {
-				newPeer, err := NodeIDToPeer(nodeID)
-				if err == nil {
-					pm.Peers[nodeID] = newPeer
-				}
-			}
+// AddPeer Adds a new peer to the peer list, unless we already have a connection to it.
+func (pm *PeerManager) AddPeer(peer *Peer) error {
+	return pm.Peers.Add(peer, func(existing *Peer, inbound, outbound int) error {
+		if existing != nil {
+			return ErrDuplicatePeer
 		}
+		return nil
+	})
+}
+
+// HasPeer reports whether we already have an active peer with this NodeID.
+func (pm *PeerManager) HasPeer(nodeID NodeID) bool {
+	return pm.Peers.Get(nodeID) != nil
+}
+
+// PeerCount returns how many active peers we have.
+func (pm *PeerManager) PeerCount() int {
+	return pm.Peers.Count()
+}
+
+// RemovePeer Removes a peer from the peer list.
+func (pm *PeerManager) RemovePeer(nodeID NodeID) {
+	if peer := pm.Peers.Get(nodeID); peer != nil {
+		pm.Peers.Remove(peer)
 	}
 }
 
 // SendHelloRequest sends a HelloRequest to the peer.
+// It must be called before the read loop is started, so that the peer's identity is known
+// before any of its messages are handled.
 func (p *Peer) SendHelloRequest(request *HelloRequest) (*HelloResponse, error) {
+	p.pendingMutex.Lock()
+	p.nextRequestID++
 	message := Message{
-		Type:     MessageTypeHelloRequest,
-		HelloReq: request,
+		Type:      MessageTypeHelloRequest,
+		RequestID: p.nextRequestID,
+		HelloReq:  request,
 	}
+	p.pendingMutex.Unlock()
+
 	err := p.sendMessage(&message)
 	if err != nil {
 		return nil, err
 	}
 
-	// Assuming we get a response immediately after a request
-	responseMessage, err := p.receiveMessage()
+	// Set a deadline on the connection for the read operation
+	err = p.Conn.SetReadDeadline(time.Now().Add(RequestTimeout))
 	if err != nil {
 		return nil, err
 	}
+	defer p.Conn.SetReadDeadline(time.Time{})
+
+	var responseMessage Message
+	err = p.decoder.Decode(&responseMessage)
+	if err != nil {
+		// If the deadline was exceeded, return a custom error message
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return nil, fmt.Errorf("hello: timeout")
+		}
+		return nil, err
+	}
 
 	// Check if we received the correct message type
-	if responseMessage.Type != MessageTypeHelloResponse {
+	if responseMessage.Type != MessageTypeHelloResponse || responseMessage.ResponseTo != message.RequestID || responseMessage.HelloRes == nil {
 		return nil, fmt.Errorf("unexpected message type received: %v", responseMessage.Type)
 	}
 
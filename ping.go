@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// keepAlive pings p every PingInterval for as long as it is connected. A peer that stays silent
+// for IdleTimeout or misses MaxPingMisses pings in a row is disconnected, which removes it from our peers.
+func (pm *PeerManager) keepAlive(p *Peer) {
+	ticker := time.NewTicker(jitter(PingInterval))
+	defer ticker.Stop()
+
+	misses := 0
+	for {
+		select {
+		case <-p.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if idle := p.Idle(); idle > IdleTimeout {
+			Log(INFO, fmt.Sprintf("disconnecting peer %s: idle for %v", p.NodeID, idle.Round(time.Second)))
+			p.Close()
+			return
+		}
+
+		rtt, err := p.Ping()
+		if err != nil {
+			misses++
+			Log(DEBUG, fmt.Sprintf("ping to peer %s failed (%d/%d): %v", p.NodeID, misses, MaxPingMisses, err))
+			if misses >= MaxPingMisses {
+				Log(INFO, fmt.Sprintf("disconnecting peer %s: not answering pings", p.NodeID))
+				p.Close()
+				return
+			}
+			continue
+		}
+		misses = 0
+		Log(DEBUG, fmt.Sprintf("peer %s round trip time %v", p.NodeID, rtt))
+	}
+}
+
+// Ping sends a ping to the peer, waits for the pong and folds the round trip time into the peer's latency.
+func (p *Peer) Ping() (time.Duration, error) {
+	start := time.Now()
+	response, err := p.Request(&Message{Type: MessageTypePing})
+	if err != nil {
+		return 0, err
+	}
+	if response.Type != MessageTypePong {
+		return 0, fmt.Errorf("unexpected message type received: %v", response.Type)
+	}
+	rtt := time.Since(start)
+
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	// Keep a moving average so one slow pong doesn't swing peer selection
+	if p.latency == 0 {
+		p.latency = rtt
+	} else {
+		p.latency = (p.latency*4 + rtt) / 5
+	}
+	return rtt, nil
+}
+
+// handlePing answers a ping with a pong.
+func (pm *PeerManager) handlePing(p *Peer, message *Message) {
+	if err := p.Reply(message, &Message{Type: MessageTypePong}); err != nil {
+		Log(DEBUG, fmt.Sprintf("Failed to send pong to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// Latency returns the peer's smoothed round trip time, or 0 if it has not answered a ping yet.
+func (p *Peer) Latency() time.Duration {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	return p.latency
+}
+
+// Idle returns how long it has been since we last heard from the peer.
+func (p *Peer) Idle() time.Duration {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	return time.Since(p.lastReceived)
+}
+
+// markReceived records that the peer just sent us something.
+func (p *Peer) markReceived() {
+	p.statsMutex.Lock()
+	p.lastReceived = time.Now()
+	p.statsMutex.Unlock()
+}
+
+// PeersByLatency returns our active peers, fastest first. Peers we have no round trip time for yet come last.
+func (pm *PeerManager) PeersByLatency() []*Peer {
+	peers := pm.Peers.List()
+	latencies := make(map[*Peer]time.Duration, len(peers))
+	for _, peer := range peers {
+		latencies[peer] = peer.Latency()
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, b := latencies[peers[i]], latencies[peers[j]]
+		if a == 0 || b == 0 {
+			return a != 0
+		}
+		return a < b
+	})
+	return peers
+}
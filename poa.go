@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotOurSlot is returned when we are asked to issue a block outside a slot of ours.
+var ErrNotOurSlot = errors.New("the current slot is not ours")
+
+// LoadGenesis reads a genesis file. Each line is "name: value", where name is one of
+//
+//	start: the RFC 3339 time slot 0 begins at
+//	slot: the length of a slot, such as 5s
+//	authority: the hex key of an authority, optionally followed by its weight, 1 by default
+//
+// Blank lines and lines starting with # are ignored. Every node of a chain must use the same file.
+func LoadGenesis(path string) (*Genesis, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	g := &Genesis{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected \"name: value\"", path, lineNumber)
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(name) {
+		case "start":
+			g.Start, err = time.Parse(time.RFC3339, value)
+		case "slot":
+			g.Slot, err = time.ParseDuration(value)
+		case "authority":
+			var authority Authority
+			authority, err = parseAuthority(value)
+			g.Authorities = append(g.Authorities, authority)
+		default:
+			err = fmt.Errorf("unknown setting %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if g.Start.IsZero() {
+		return nil, fmt.Errorf("%s: no start time", path)
+	}
+	if g.Slot < time.Second || g.Slot%time.Second != 0 {
+		return nil, fmt.Errorf("%s: slot must be a whole number of seconds, got %v", path, g.Slot)
+	}
+	if len(g.Authorities) == 0 {
+		return nil, fmt.Errorf("%s: no authorities", path)
+	}
+	g.Start = g.Start.Truncate(time.Second)
+	sortAuthorities(g.Authorities)
+	for i := 1; i < len(g.Authorities); i++ {
+		if g.Authorities[i].Key == g.Authorities[i-1].Key {
+			return nil, fmt.Errorf("%s: authority %x is listed twice", path, g.Authorities[i].Key)
+		}
+	}
+	return g, nil
+}
+
+// parseAuthority parses a hex key optionally followed by a weight.
+func parseAuthority(s string) (Authority, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Authority{}, fmt.Errorf("expected a key and an optional weight, got %q", s)
+	}
+	authority := Authority{Weight: 1}
+	if err := parseHex(fields[0], authority.Key[:]); err != nil {
+		return Authority{}, fmt.Errorf("invalid authority key: %w", err)
+	}
+	if len(fields) == 2 {
+		weight, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil || weight < 1 || weight > MaxAuthorityWeight {
+			return Authority{}, fmt.Errorf("authority weight must be from 1 to %d, got %q", MaxAuthorityWeight, fields[1])
+		}
+		authority.Weight = weight
+	}
+	return authority, nil
+}
+
+func sortAuthorities(authorities []Authority) {
+	sort.Slice(authorities, func(i, j int) bool {
+		return bytes.Compare(authorities[i].Key[:], authorities[j].Key[:]) < 0
+	})
+}
+
+// NewProofOfAuthority starts a proof of authority engine from the authority set of g.
+func NewProofOfAuthority(g *Genesis) *ProofOfAuthority {
+	poa := &ProofOfAuthority{Genesis: g, Proposals: make(map[PublicKey]uint64)}
+	poa.reset()
+	return poa
+}
+
+// reset goes back to the genesis authority set, before any block was counted.
+func (poa *ProofOfAuthority) reset() {
+	poa.Authorities = append([]Authority(nil), poa.Genesis.Authorities...)
+	poa.Votes = make(map[AuthorityVote]map[PublicKey]bool)
+	poa.Counted = 0
+	poa.CountedHash = Hash{}
+}
+
+// catchUp counts the votes of the blocks added to c since we last looked, starting over if our
+// chain has changed below them. The caller must hold c.Mutex.
+func (poa *ProofOfAuthority) catchUp(c *Chain) {
+	if poa.Counted > uint64(len(c.BlockHistory)) || poa.Counted > 0 && c.BlockHistory[poa.Counted-1].BlockHash != poa.CountedHash {
+		poa.reset()
+	}
+	for _, block := range c.BlockHistory[poa.Counted:] {
+		poa.count(block.Issuer, block.Vote)
+		poa.Counted++
+		poa.CountedHash = block.BlockHash
+	}
+}
+
+// count records issuer's vote. Once more than half of the authorities agree on a change it takes effect,
+// and the votes about its key are cleared.
+func (poa *ProofOfAuthority) count(issuer PublicKey, vote AuthorityVote) {
+	if vote == (AuthorityVote{}) {
+		return
+	}
+
+	// An authority's new vote about a key replaces its earlier one
+	for proposal, voters := range poa.Votes {
+		if proposal.Key == vote.Key {
+			delete(voters, issuer)
+			if len(voters) == 0 {
+				delete(poa.Votes, proposal)
+			}
+		}
+	}
+	if poa.Votes[vote] == nil {
+		poa.Votes[vote] = make(map[PublicKey]bool)
+	}
+	poa.Votes[vote][issuer] = true
+	if len(poa.Votes[vote]) <= len(poa.Authorities)/2 {
+		return
+	}
+
+	for proposal := range poa.Votes {
+		if proposal.Key == vote.Key {
+			delete(poa.Votes, proposal)
+		}
+	}
+	authorities := make([]Authority, 0, len(poa.Authorities)+1)
+	for _, authority := range poa.Authorities {
+		if authority.Key != vote.Key {
+			authorities = append(authorities, authority)
+		}
+	}
+	if vote.Weight > 0 {
+		authorities = append(authorities, Authority{Key: vote.Key, Weight: vote.Weight})
+		sortAuthorities(authorities)
+	} else {
+		// A removed authority's votes no longer count
+		for proposal, voters := range poa.Votes {
+			delete(voters, vote.Key)
+			if len(voters) == 0 {
+				delete(poa.Votes, proposal)
+			}
+		}
+	}
+	poa.Authorities = authorities
+	Log(INFO, fmt.Sprintf("authority %x now has weight %d, %d authorities in the set", vote.Key, vote.Weight, len(authorities)))
+}
+
+// weight returns the weight of key in the current authority set, 0 if it isn't in it.
+func (poa *ProofOfAuthority) weight(key PublicKey) uint64 {
+	for _, authority := range poa.Authorities {
+		if authority.Key == key {
+			return authority.Weight
+		}
+	}
+	return 0
+}
+
+// slot returns the slot t falls in, or false if t is before slot 0. Only whole seconds count, as only they are hashed.
+func (poa *ProofOfAuthority) slot(t time.Time) (uint64, bool) {
+	t = time.Unix(t.Unix(), 0)
+	if t.Before(poa.Genesis.Start) {
+		return 0, false
+	}
+	return uint64(t.Sub(poa.Genesis.Start) / poa.Genesis.Slot), true
+}
+
+// scheduled returns the authority that may issue the block of slot. The schedule goes round the authorities
+// in key order, giving each as many slots in a row as its weight.
+func (poa *ProofOfAuthority) scheduled(slot uint64) PublicKey {
+	var total uint64
+	for _, authority := range poa.Authorities {
+		total += authority.Weight
+	}
+	position := slot % total
+	for _, authority := range poa.Authorities {
+		if position < authority.Weight {
+			return authority.Key
+		}
+		position -= authority.Weight
+	}
+	return PublicKey{}
+}
+
+// checkSlot checks that block is issued by the authority scheduled for its slot, in a later slot than
+// the block before it. The caller must hold c.Mutex and have caught up.
+func (poa *ProofOfAuthority) checkSlot(c *Chain, block *Block) error {
+	slot, ok := poa.slot(block.Timestamp)
+	if !ok {
+		return errors.New("block timestamp is before the genesis start")
+	}
+	if len(c.BlockHistory) > 0 {
+		if parentSlot, _ := poa.slot(c.BlockHistory[len(c.BlockHistory)-1].Timestamp); slot <= parentSlot {
+			return fmt.Errorf("slot %d already has a block or is over", slot)
+		}
+	}
+	if issuer := poa.scheduled(slot); block.Issuer != issuer {
+		return fmt.Errorf("slot %d belongs to %x, not %x", slot, issuer, block.Issuer)
+	}
+	return nil
+}
+
+// checkVote checks that a vote could change the authority set without emptying it.
+func (poa *ProofOfAuthority) checkVote(vote AuthorityVote) error {
+	if vote == (AuthorityVote{}) {
+		return nil
+	}
+	if vote.Key == (PublicKey{}) {
+		return errors.New("vote without a key")
+	}
+	if vote.Weight > MaxAuthorityWeight {
+		return fmt.Errorf("vote weight %d is more than %d", vote.Weight, MaxAuthorityWeight)
+	}
+	if poa.weight(vote.Key) == vote.Weight {
+		return fmt.Errorf("authority %x already has weight %d", vote.Key, vote.Weight)
+	}
+	if vote.Weight == 0 && len(poa.Authorities) == 1 {
+		return errors.New("vote would remove the last authority")
+	}
+	return nil
+}
+
+// Prepare checks that the block falls in a slot of ours, returning ErrNotOurSlot if it doesn't,
+// and casts the first of our proposals that we haven't voted for yet.
+func (poa *ProofOfAuthority) Prepare(c *Chain, block *Block) error {
+	poa.catchUp(c)
+	if err := poa.checkSlot(c, block); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotOurSlot, err)
+	}
+
+	keys := make([]PublicKey, 0, len(poa.Proposals))
+	for key := range poa.Proposals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	for _, key := range keys {
+		vote := AuthorityVote{Key: key, Weight: poa.Proposals[key]}
+		if poa.checkVote(vote) != nil {
+			// The change has been made, or can't be
+			delete(poa.Proposals, key)
+			continue
+		}
+		if !poa.Votes[vote][block.Issuer] {
+			block.Vote = vote
+			break
+		}
+	}
+	return nil
+}
+
+func (poa *ProofOfAuthority) Seal(ctx context.Context, block *Block, key PrivateKey) error {
+	return block.Sign(key)
+}
+
+// Verify checks the block's issuer and slot against the schedule of the current authority set,
+// and that any vote it carries is one the set can take.
+func (poa *ProofOfAuthority) Verify(c *Chain, block *Block) error {
+	poa.catchUp(c)
+	if block.Version < BlockVersionMerkle {
+		return fmt.Errorf("block version %d cannot carry an authority vote", block.Version)
+	}
+	if block.Timestamp.After(time.Now().Add(MaxSlotDrift)) {
+		return fmt.Errorf("%w: it is in a future slot", ErrBlockFromFuture)
+	}
+	if err := poa.checkSlot(c, block); err != nil {
+		return err
+	}
+	return poa.checkVote(block.Vote)
+}
+
+// Work is nil, as slots never give two authorities the same block to issue and so there is no fork to choose.
+func (poa *ProofOfAuthority) Work(header *BlockHeader) *big.Int {
+	return nil
+}
+
+// Authorities returns the current authority set of a proof of authority chain and the votes still open.
+func (c *Chain) Authorities() ([]Authority, map[AuthorityVote][]PublicKey, error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	poa, ok := c.Consensus.(*ProofOfAuthority)
+	if !ok {
+		return nil, nil, errors.New("the chain does not follow proof of authority")
+	}
+	poa.catchUp(c)
+
+	votes := make(map[AuthorityVote][]PublicKey, len(poa.Votes))
+	for proposal, voters := range poa.Votes {
+		for voter := range voters {
+			votes[proposal] = append(votes[proposal], voter)
+		}
+	}
+	return append([]Authority(nil), poa.Authorities...), votes, nil
+}
+
+// ProposeAuthority has us vote for key to have weight in the blocks we issue, until the change is made.
+func (c *Chain) ProposeAuthority(vote AuthorityVote) error {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	poa, ok := c.Consensus.(*ProofOfAuthority)
+	if !ok {
+		return errors.New("the chain does not follow proof of authority")
+	}
+	if vote.Key == (PublicKey{}) {
+		return errors.New("vote without a key")
+	}
+	poa.catchUp(c)
+	if err := poa.checkVote(vote); err != nil {
+		return err
+	}
+	poa.Proposals[vote.Key] = vote.Weight
+	return nil
+}
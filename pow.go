@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// newConsensus returns the consensus engine chosen with -consensus.
+func newConsensus() Consensus {
+	switch consensusMode {
+	case "pow":
+		return &ProofOfWork{BlockTime: blockTime, Threads: minerThreads}
+	case "poa":
+		return NewProofOfAuthority(genesis)
+	default:
+		return SignedConsensus{}
+	}
+}
+
+func (SignedConsensus) Prepare(c *Chain, block *Block) error {
+	return nil
+}
+
+func (SignedConsensus) Seal(ctx context.Context, block *Block, key PrivateKey) error {
+	return block.Sign(key)
+}
+
+func (SignedConsensus) Verify(c *Chain, block *Block) error {
+	return nil
+}
+
+func (SignedConsensus) Work(header *BlockHeader) *big.Int {
+	return nil
+}
+
+// targetInt reads a Target as the number it encodes.
+func targetInt(target Hash) *big.Int {
+	return new(big.Int).SetBytes(target[:])
+}
+
+// targetHash encodes n, which must fit in 256 bits, as a Target.
+func targetHash(n *big.Int) Hash {
+	var target Hash
+	n.FillBytes(target[:])
+	return target
+}
+
+// MeetsTarget reports whether hash, read as a big-endian number, is at most target. A zero target is never met.
+func MeetsTarget(hash Hash, target Hash) bool {
+	t := targetInt(target)
+	return t.Sign() > 0 && targetInt(hash).Cmp(t) <= 0
+}
+
+// Prepare moves the block on to BlockVersionWork, sets the Target it must meet and makes sure
+// its timestamp is late enough to be accepted.
+func (pow *ProofOfWork) Prepare(c *Chain, block *Block) error {
+	block.Version = BlockVersionWork
+	block.Target = pow.nextTarget(c, block)
+	if earliest := c.medianTimePastLocked(block.ParentHash).Add(time.Second); block.Timestamp.Before(earliest) {
+		block.Timestamp = earliest
+	}
+	return nil
+}
+
+// Seal searches for a nonce that brings the block's hash under its Target, on pow.Threads goroutines
+// that each start from a random nonce, then signs the block. It gives up once ctx is cancelled.
+func (pow *ProofOfWork) Seal(ctx context.Context, block *Block, key PrivateKey) error {
+	header := block.Header()
+	header.TxHashes = nil
+
+	threads := pow.Threads
+	if threads < 1 {
+		threads = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan Nonce, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		var start Nonce
+		if _, err := rand.Read(start[:]); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(header BlockHeader) {
+			defer wg.Done()
+			header.Nonce = start
+			counter := binary.LittleEndian.Uint64(header.Nonce[:8])
+			for {
+				// Check for cancellation every few thousand hashes rather than on every one
+				for j := 0; j < 4096; j++ {
+					if MeetsTarget(header.Hash(), header.Target) {
+						found <- header.Nonce
+						return
+					}
+					counter++
+					binary.LittleEndian.PutUint64(header.Nonce[:8], counter)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+			}
+		}(header)
+	}
+
+	var err error
+	select {
+	case block.Nonce = <-found:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	cancel()
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return block.signHash(key)
+}
+
+// Verify checks that the block carries the Target its chain calls for, and that its timestamp is after the
+// median of the blocks before it and not too far in the future. Its hash was checked against the Target by Validate.
+func (pow *ProofOfWork) Verify(c *Chain, block *Block) error {
+	if block.Version < BlockVersionWork {
+		return fmt.Errorf("block version %d has no proof of work", block.Version)
+	}
+	if expected := pow.nextTarget(c, block); block.Target != expected {
+		return fmt.Errorf("block target %x should be %x", block.Target, expected)
+	}
+	if !block.Timestamp.After(c.medianTimePastLocked(block.ParentHash)) {
+		return errors.New("block timestamp is not after the median time of the blocks before it")
+	}
+	if block.Timestamp.After(time.Now().Add(MaxFutureBlockTime)) {
+		return ErrBlockFromFuture
+	}
+	return nil
+}
+
+// Work is the expected number of hashes it took to find a block with the header's Target, 2^256 / (Target+1).
+func (pow *ProofOfWork) Work(header *BlockHeader) *big.Int {
+	if header.Version < BlockVersionWork {
+		return new(big.Int)
+	}
+	total := new(big.Int).Lsh(big.NewInt(1), 256)
+	return total.Div(total, targetInt(header.Target).Add(targetInt(header.Target), big.NewInt(1)))
+}
+
+// nextTarget returns the Target of a block following block.ParentHash. The first block and every block
+// after a pre-work block start at PowLimit. Every RetargetInterval blocks the Target is scaled by how long
+// the last RetargetInterval blocks took against pow.BlockTime each, by at most MaxRetargetFactor either way.
+// The caller must hold c.Mutex.
+func (pow *ProofOfWork) nextTarget(c *Chain, block *Block) Hash {
+	ancestors := c.ancestorsLocked(block.ParentHash, RetargetInterval)
+	if len(ancestors) == 0 || ancestors[0].Version < BlockVersionWork {
+		return targetHash(PowLimit)
+	}
+	parent := ancestors[0]
+	if (block.Height-1)%RetargetInterval != 0 || len(ancestors) < RetargetInterval {
+		return parent.Target
+	}
+
+	first := ancestors[len(ancestors)-1]
+	expected := pow.BlockTime * time.Duration(RetargetInterval-1)
+	actual := parent.Timestamp.Sub(first.Timestamp)
+	if actual < expected/MaxRetargetFactor {
+		actual = expected / MaxRetargetFactor
+	}
+	if actual > expected*MaxRetargetFactor {
+		actual = expected * MaxRetargetFactor
+	}
+
+	target := targetInt(parent.Target)
+	target.Mul(target, big.NewInt(int64(actual)))
+	target.Div(target, big.NewInt(int64(expected)))
+	if target.Cmp(PowLimit) > 0 {
+		target.Set(PowLimit)
+	}
+	if target.Sign() == 0 {
+		target.SetInt64(1)
+	}
+	return targetHash(target)
+}
+
+// medianTimePastLocked returns the median timestamp of the last MedianTimeBlocks blocks up to the one with hash,
+// or the zero time if there are none. The caller must hold c.Mutex.
+func (c *Chain) medianTimePastLocked(hash Hash) time.Time {
+	ancestors := c.ancestorsLocked(hash, MedianTimeBlocks)
+	if len(ancestors) == 0 {
+		return time.Time{}
+	}
+	times := make([]time.Time, len(ancestors))
+	for i, block := range ancestors {
+		times[i] = block.Timestamp
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times[len(times)/2]
+}
+
+// RunMiner mines our pending transactions into blocks and broadcasts them until we shut down.
+func (pm *PeerManager) RunMiner() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.Context.Done():
+			return
+		case <-ticker.C:
+		}
+		if len(pm.Chain.Pending()) > 0 {
+			pm.mineBlock()
+		}
+	}
+}
+
+// mineBlock mines one block on top of our tip. The block is abandoned as soon as another block
+// takes our tip, since it could then only start a side chain.
+func (pm *PeerManager) mineBlock() {
+	_, tip := pm.Chain.Tip()
+	ctx, cancel := context.WithCancel(pm.Context)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, hash := pm.Chain.Tip(); hash != tip {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	block, err := pm.Chain.MineBlock(ctx, pm.Keys.PrivateKey)
+	if err != nil {
+		if ctx.Err() != nil {
+			Log(DEBUG, "stopped mining, our tip changed")
+			return
+		}
+		if errors.Is(err, ErrNotOurSlot) {
+			Log(DEBUG, fmt.Sprintf("not issuing a block: %v", err))
+			return
+		}
+		Log(WARNING, fmt.Sprintf("failed to mine a block: %v", err))
+		return
+	}
+	Log(INFO, fmt.Sprintf("mined block %d (%x) with %d transaction(s)", block.Height, block.BlockHash, len(block.Transactions)))
+	pm.BroadcastBlock(block)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrPeerBandwidthExceeded = errors.New("peer exceeded its download quota")
+
+// NewTokenBucket creates a full bucket that refills at rate tokens per second up to burst.
+func NewTokenBucket(rate, burst float64) *TokenBucket {
+	return &TokenBucket{
+		Mutex:  new(sync.Mutex),
+		Rate:   rate,
+		Burst:  burst,
+		Tokens: burst,
+		Last:   time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the last refill. The caller must hold tb.Mutex.
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.Tokens += now.Sub(tb.Last).Seconds() * tb.Rate
+	if tb.Tokens > tb.Burst {
+		tb.Tokens = tb.Burst
+	}
+	tb.Last = now
+}
+
+// Allow takes n tokens if they are available and reports whether it did.
+func (tb *TokenBucket) Allow(n float64) bool {
+	tb.Mutex.Lock()
+	defer tb.Mutex.Unlock()
+
+	tb.refill(time.Now())
+	if tb.Tokens < n {
+		return false
+	}
+	tb.Tokens -= n
+	return true
+}
+
+// Reserve takes n tokens, borrowing against future refills if needed, and returns how long
+// the caller should wait before using them.
+func (tb *TokenBucket) Reserve(n float64) time.Duration {
+	tb.Mutex.Lock()
+	defer tb.Mutex.Unlock()
+
+	tb.refill(time.Now())
+	tb.Tokens -= n
+	if tb.Tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.Tokens / tb.Rate * float64(time.Second))
+}
+
+// NewGlobalLimits creates the bandwidth caps from the -maxdownload and -maxupload flags.
+func NewGlobalLimits() *GlobalLimits {
+	limits := &GlobalLimits{}
+	if maxDownloadKB > 0 {
+		rate := float64(maxDownloadKB) * 1024
+		limits.Download = NewTokenBucket(rate, rate)
+	}
+	if maxUploadKB > 0 {
+		rate := float64(maxUploadKB) * 1024
+		limits.Upload = NewTokenBucket(rate, rate)
+	}
+	return limits
+}
+
+// NewPeerLimits creates fresh rate limits for a new connection.
+func NewPeerLimits() *PeerLimits {
+	limits := &PeerLimits{
+		Messages: make(map[MessageType]*TokenBucket),
+		Mutex:    new(sync.Mutex),
+	}
+	if peerDownloadKB > 0 {
+		rate := float64(peerDownloadKB) * 1024
+		limits.Download = NewTokenBucket(rate, rate*PeerDownloadBurstSec)
+	}
+	return limits
+}
+
+// NewMetrics creates an empty set of traffic counters.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Mutex:            new(sync.Mutex),
+		MessagesReceived: make(map[string]uint64),
+		MessagesDropped:  make(map[string]uint64),
+	}
+}
+
+// allowMessage counts an inbound message and checks it against the peer's rate limit for its type.
+// Messages over the limit are dropped and the peer is charged for flooding.
+func (pm *PeerManager) allowMessage(p *Peer, message *Message) bool {
+	pm.Metrics.Mutex.Lock()
+	pm.Metrics.MessagesReceived[message.Type.String()]++
+	pm.Metrics.Mutex.Unlock()
+
+	p.Limits.Mutex.Lock()
+	bucket, exists := p.Limits.Messages[message.Type]
+	if !exists {
+		limit, exists := MessageRateLimits[message.Type]
+		if !exists {
+			limit = DefaultMessageRateLimit
+		}
+		bucket = NewTokenBucket(limit.Rate, limit.Burst)
+		p.Limits.Messages[message.Type] = bucket
+	}
+	p.Limits.Mutex.Unlock()
+
+	if bucket.Allow(1) {
+		return true
+	}
+
+	p.Limits.Mutex.Lock()
+	p.Limits.Dropped++
+	p.Limits.Mutex.Unlock()
+
+	pm.Metrics.Mutex.Lock()
+	pm.Metrics.MessagesDropped[message.Type.String()]++
+	pm.Metrics.Mutex.Unlock()
+
+	pm.Misbehaving(p, OffenseFlooding, fmt.Sprintf("too many %s messages", message.Type))
+	return false
+}
+
+// meteredConn counts the bytes moving over a peer connection and enforces the
+// peer's download quota and our global bandwidth caps.
+type meteredConn struct {
+	net.Conn
+	peer    *PeerLimits
+	global  *GlobalLimits
+	metrics *Metrics
+}
+
+// meter wraps conn so its traffic is counted and limited.
+func (pm *PeerManager) meter(conn net.Conn, limits *PeerLimits) net.Conn {
+	return &meteredConn{
+		Conn:    conn,
+		peer:    limits,
+		global:  pm.Limits,
+		metrics: pm.Metrics,
+	}
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 {
+		return n, err
+	}
+
+	c.peer.Mutex.Lock()
+	c.peer.BytesIn += uint64(n)
+	c.peer.Mutex.Unlock()
+
+	c.metrics.Mutex.Lock()
+	c.metrics.BytesReceived += uint64(n)
+	c.metrics.Mutex.Unlock()
+
+	if c.peer.Download != nil && !c.peer.Download.Allow(float64(n)) {
+		// Report no data along with the error, or the decoder may consume the data and drop the error
+		return 0, ErrPeerBandwidthExceeded
+	}
+	if c.global.Download != nil {
+		time.Sleep(c.global.Download.Reserve(float64(n)))
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	if c.global.Upload != nil {
+		time.Sleep(c.global.Upload.Reserve(float64(len(b))))
+	}
+
+	n, err := c.Conn.Write(b)
+
+	c.peer.Mutex.Lock()
+	c.peer.BytesOut += uint64(n)
+	c.peer.Mutex.Unlock()
+
+	c.metrics.Mutex.Lock()
+	c.metrics.BytesSent += uint64(n)
+	c.metrics.Mutex.Unlock()
+	return n, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// NewPeerRegistry creates an empty peer registry.
+func NewPeerRegistry() *PeerRegistry {
+	return &PeerRegistry{
+		Mutex:       new(sync.Mutex),
+		Peers:       make(map[NodeID]*Peer),
+		Subscribers: make(map[int]chan PeerEvent),
+	}
+}
+
+// Add registers p as our active connection to its NodeID. admit is called with the registry locked
+// and is given the connection p would replace, if any, and how many inbound and outbound peers we have.
+// p is only added if admit returns nil, in which case the connection it replaces is unregistered.
+func (r *PeerRegistry) Add(p *Peer, admit func(existing *Peer, inbound, outbound int) error) error {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	existing := r.Peers[p.NodeID]
+	inbound, outbound := r.countLocked()
+	if err := admit(existing, inbound, outbound); err != nil {
+		return err
+	}
+
+	if existing != nil {
+		r.publishLocked(PeerEvent{Type: PeerDisconnected, Peer: existing})
+	}
+	r.Peers[p.NodeID] = p
+	r.publishLocked(PeerEvent{Type: PeerConnected, Peer: p})
+	return nil
+}
+
+// Remove unregisters p. It does nothing if p has already been replaced by another connection to the same peer.
+func (r *PeerRegistry) Remove(p *Peer) bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	if r.Peers[p.NodeID] != p {
+		return false
+	}
+	delete(r.Peers, p.NodeID)
+	r.publishLocked(PeerEvent{Type: PeerDisconnected, Peer: p})
+	return true
+}
+
+// Get returns the active peer with nodeID, or nil.
+func (r *PeerRegistry) Get(nodeID NodeID) *Peer {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	return r.Peers[nodeID]
+}
+
+// List returns a snapshot of the active peers.
+func (r *PeerRegistry) List() []*Peer {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	peers := make([]*Peer, 0, len(r.Peers))
+	for _, peer := range r.Peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Count returns how many active peers we have.
+func (r *PeerRegistry) Count() int {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	return len(r.Peers)
+}
+
+// Counts returns how many inbound and outbound peers we have.
+func (r *PeerRegistry) Counts() (int, int) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	return r.countLocked()
+}
+
+// countLocked returns how many inbound and outbound peers we have. The caller must hold r.Mutex.
+func (r *PeerRegistry) countLocked() (int, int) {
+	inbound, outbound := 0, 0
+	for _, peer := range r.Peers {
+		if peer.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	return inbound, outbound
+}
+
+// Subscribe returns a channel that receives an event whenever a peer connects or disconnects,
+// and a function that cancels the subscription. Events are dropped if the channel is full.
+func (r *PeerRegistry) Subscribe() (<-chan PeerEvent, func()) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	id := r.nextSubscriber
+	r.nextSubscriber++
+	events := make(chan PeerEvent, PeerEventBuffer)
+	r.Subscribers[id] = events
+
+	unsubscribe := func() {
+		r.Mutex.Lock()
+		defer r.Mutex.Unlock()
+
+		delete(r.Subscribers, id)
+	}
+	return events, unsubscribe
+}
+
+// publishLocked sends event to every subscriber. The caller must hold r.Mutex.
+func (r *PeerRegistry) publishLocked(event PeerEvent) {
+	for id, events := range r.Subscribers {
+		select {
+		case events <- event:
+		default:
+			Log(WARNING, fmt.Sprintf("peer event subscriber %d is not keeping up, dropped %s event for peer %s", id, event.Type, event.Peer.NodeID))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// testPeer returns a peer with a new key that isn't connected to anything.
+func testPeer(t *testing.T, inbound bool) *Peer {
+	t.Helper()
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Peer{NodeID: NodeIDFromKey(keys.PublicKey), PublicKey: keys.PublicKey, Inbound: inbound}
+}
+
+func TestPeerRegistryConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		rounds  = 200
+	)
+	r := NewPeerRegistry()
+	admit := func(existing *Peer, inbound, outbound int) error {
+		return nil
+	}
+
+	// Some NodeIDs are shared between workers, so connections replace each other as they would on a reconnect
+	shared := make([]NodeID, 4)
+	for i := range shared {
+		shared[i] = testPeer(t, false).NodeID
+	}
+
+	// Subscribers come and go while peers change, each draining its events until it unsubscribes
+	stop := make(chan struct{})
+	var subscribers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			for {
+				events, unsubscribe := r.Subscribe()
+				for j := 0; j < 50; j++ {
+					select {
+					case event := <-events:
+						if event.Peer == nil {
+							t.Error("peer event without a peer")
+						}
+					case <-stop:
+						unsubscribe()
+						return
+					}
+				}
+				unsubscribe()
+			}
+		}()
+	}
+
+	peers := make([][]*Peer, workers)
+	for w := range peers {
+		for i := 0; i < rounds; i++ {
+			p := testPeer(t, i%2 == 0)
+			if i%3 == 0 {
+				p.NodeID = shared[(w+i)%len(shared)]
+			}
+			peers[w] = append(peers[w], p)
+		}
+	}
+
+	var workersDone sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workersDone.Add(1)
+		go func(w int) {
+			defer workersDone.Done()
+			for _, p := range peers[w] {
+				if err := r.Add(p, admit); err != nil {
+					t.Errorf("add: %v", err)
+					return
+				}
+				for _, peer := range r.List() {
+					if peer == nil {
+						t.Error("nil peer in list")
+					}
+				}
+				if inbound, outbound := r.Counts(); inbound+outbound > workers {
+					t.Errorf("counted %d inbound and %d outbound peers with %d workers adding one each", inbound, outbound, workers)
+				}
+				r.Get(p.NodeID)
+				r.Remove(p)
+			}
+		}(w)
+	}
+	workersDone.Wait()
+	close(stop)
+	subscribers.Wait()
+
+	if count := r.Count(); count != 0 {
+		t.Fatalf("registry holds %d peers after every peer was removed", count)
+	}
+	if len(r.Subscribers) != 0 {
+		t.Fatalf("registry holds %d subscribers after every subscription was cancelled", len(r.Subscribers))
+	}
+}
+
+func TestPeerRegistryReplace(t *testing.T) {
+	r := NewPeerRegistry()
+	events, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+
+	admit := func(existing *Peer, inbound, outbound int) error {
+		return nil
+	}
+	first := testPeer(t, true)
+	if err := r.Add(first, admit); err != nil {
+		t.Fatal(err)
+	}
+	second := &Peer{NodeID: first.NodeID}
+	if err := r.Add(second, admit); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old connection is gone and removing it must not take the new one with it
+	if r.Remove(first) {
+		t.Fatal("removed a connection that had been replaced")
+	}
+	if r.Get(first.NodeID) != second {
+		t.Fatal("replacing connection is not registered")
+	}
+	if inbound, outbound := r.Counts(); inbound != 0 || outbound != 1 {
+		t.Fatalf("got %d inbound and %d outbound peers, want 0 and 1", inbound, outbound)
+	}
+
+	expected := []PeerEvent{
+		{Type: PeerConnected, Peer: first},
+		{Type: PeerDisconnected, Peer: first},
+		{Type: PeerConnected, Peer: second},
+	}
+	for _, want := range expected {
+		if got := <-events; got != want {
+			t.Fatalf("got %s event for %p, want %s for %p", got.Type, got.Peer, want.Type, want.Peer)
+		}
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StartRPCServer serves the local admin API on address in the background until the returned server is shut down.
+// Requests that change anything must carry the cookie we write to RPCCookieFilename, which only local users can read.
+func StartRPCServer(address string, pm *PeerManager) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bans", pm.rpcBans)
+	mux.HandleFunc("/metrics", pm.rpcMetrics)
+	mux.HandleFunc("/sync", pm.rpcSync)
+	mux.HandleFunc("/tx", pm.rpcTx)
+	mux.HandleFunc("/account", pm.rpcAccount)
+	mux.HandleFunc("/filters", pm.rpcFilters)
+	mux.HandleFunc("/scan", pm.rpcScan)
+	mux.HandleFunc("/authorities", pm.rpcAuthorities)
+
+	cookie, err := writeRPCCookie(RPCCookieFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write admin RPC cookie: %w", err)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string]bool{address: true, listener.Addr().String(): true}
+	server := &http.Server{Handler: rpcGuard(hosts, cookie, mux)}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			Log(ERROR, fmt.Sprintf("admin RPC server failed: %v", err))
+		}
+	}()
+
+	Log(INFO, fmt.Sprintf("admin RPC listening on %s", address))
+	return server, nil
+}
+
+// writeRPCCookie writes a new random cookie to path, readable by our user only, and returns it.
+func writeRPCCookie(path string) (string, error) {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", err
+	}
+	cookie := hex.EncodeToString(secret[:])
+	if err := os.WriteFile(path, []byte(cookie), 0600); err != nil {
+		return "", err
+	}
+	return cookie, nil
+}
+
+// rpcGuard only passes on requests addressed to one of hosts, so that a web page can reach the admin API
+// neither directly nor through DNS rebinding. Requests that aren't GETs must also carry cookie.
+func rpcGuard(hosts map[string]bool, cookie string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hosts[r.Host] {
+			http.Error(w, "unexpected host", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !hosts[strings.TrimPrefix(origin, "http://")] {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+cookie)) != 1 {
+			http.Error(w, "missing or wrong admin RPC cookie", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rpcBans lists the active bans on GET, and on DELETE lifts the ban on the address
+// query parameter, or every ban if it is missing.
+func (pm *PeerManager) rpcBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, pm.Bans.List())
+	case http.MethodDelete:
+		cleared, err := pm.Bans.Clear(r.URL.Query().Get("address"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]int{"Cleared": cleared})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type PeerMetrics struct {
+	NodeID        NodeID // This is the peer's identifier.
+	Address       string // This is the peer's host:port.
+	Inbound       bool   // This is true if the peer dialed us.
+	Score         int    // This is the misbehavior score of the connection.
+	BytesReceived uint64 // This is how many bytes we have read from the peer.
+	BytesSent     uint64 // This is how many bytes we have written to the peer.
+	Dropped       uint64 // This is how many of the peer's messages were dropped by rate limits.
+	LatencyMs     int64  // This is the smoothed ping round trip time in milliseconds, 0 if unknown.
+	IdleSeconds   int64  // This is how long ago we last heard from the peer.
+}
+
+type LimitSettings struct {
+	MaxDownloadKB  int                  // This is the total download cap in KB/s, 0 for none.
+	MaxUploadKB    int                  // This is the total upload cap in KB/s, 0 for none.
+	PeerDownloadKB int                  // This is the per-peer download quota in KB/s, 0 for none.
+	MessageRates   map[string]RateLimit // These are the per-peer message rate limits, by type.
+	DefaultRate    RateLimit            // This applies to message types without their own limit.
+}
+
+type MetricsResponse struct {
+	BytesReceived        uint64            // This is how many bytes we have read from all peers.
+	BytesSent            uint64            // This is how many bytes we have written to all peers.
+	MessagesReceived     map[string]uint64 // This counts received messages by type.
+	MessagesDropped      map[string]uint64 // This counts rate limited messages by type.
+	BandwidthDisconnects uint64            // This counts peers disconnected for exceeding their download quota.
+	CompactBlocks        uint64            // This counts compact blocks rebuilt from our pending pool alone.
+	CompactBlockFetches  uint64            // This counts compact blocks that needed missing transactions fetched.
+	CompactBlockFailures uint64            // This counts compact blocks that had to be fetched in full.
+	Limits               LimitSettings     // These are the limits in force.
+	Peers                []PeerMetrics     // These are the statistics of each active peer.
+}
+
+// rpcMetrics reports our traffic counters, the limits in force and per-peer statistics.
+func (pm *PeerManager) rpcMetrics(w http.ResponseWriter, r *http.Request) {
+	response := MetricsResponse{
+		MessagesReceived: make(map[string]uint64),
+		MessagesDropped:  make(map[string]uint64),
+		Limits: LimitSettings{
+			MaxDownloadKB:  maxDownloadKB,
+			MaxUploadKB:    maxUploadKB,
+			PeerDownloadKB: peerDownloadKB,
+			MessageRates:   make(map[string]RateLimit),
+			DefaultRate:    DefaultMessageRateLimit,
+		},
+	}
+	for messageType, limit := range MessageRateLimits {
+		response.Limits.MessageRates[messageType.String()] = limit
+	}
+
+	pm.Metrics.Mutex.Lock()
+	response.BytesReceived = pm.Metrics.BytesReceived
+	response.BytesSent = pm.Metrics.BytesSent
+	response.BandwidthDisconnects = pm.Metrics.BandwidthDisconnects
+	response.CompactBlocks = pm.Metrics.CompactBlocks
+	response.CompactBlockFetches = pm.Metrics.CompactBlockFetches
+	response.CompactBlockFailures = pm.Metrics.CompactBlockFailures
+	for name, count := range pm.Metrics.MessagesReceived {
+		response.MessagesReceived[name] = count
+	}
+	for name, count := range pm.Metrics.MessagesDropped {
+		response.MessagesDropped[name] = count
+	}
+	pm.Metrics.Mutex.Unlock()
+
+	for _, peer := range pm.Peers.List() {
+		metrics := PeerMetrics{
+			NodeID:      peer.NodeID,
+			Address:     AddressKey(peer.Address, peer.Port),
+			Inbound:     peer.Inbound,
+			LatencyMs:   peer.Latency().Milliseconds(),
+			IdleSeconds: int64(peer.Idle().Seconds()),
+		}
+		pm.Bans.Mutex.Lock()
+		metrics.Score = peer.Score
+		pm.Bans.Mutex.Unlock()
+		peer.Limits.Mutex.Lock()
+		metrics.BytesReceived = peer.Limits.BytesIn
+		metrics.BytesSent = peer.Limits.BytesOut
+		metrics.Dropped = peer.Limits.Dropped
+		peer.Limits.Mutex.Unlock()
+		response.Peers = append(response.Peers, metrics)
+	}
+
+	writeJSON(w, response)
+}
+
+// SyncStatus is a snapshot of our block download progress.
+type SyncStatus struct {
+	Syncing      bool    // This is true while we are downloading blocks.
+	Peer         NodeID  // This is the peer we downloaded the headers from.
+	Downloaders  int     // This is how many peers we are downloading blocks from.
+	Height       uint64  // This is our chain height.
+	StartHeight  uint64  // This is our chain height when the download started.
+	TargetHeight uint64  // This is the height we are downloading towards.
+	Percent      float64 // This is how much of the download is done.
+}
+
+// rpcSync reports our block download progress.
+func (pm *PeerManager) rpcSync(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, pm.Sync.Status(pm.height()))
+}
+
+// rpcTx proves that the transaction with the hash query parameter is on the chain, asking full nodes if we are a light client.
+func (pm *PeerManager) rpcTx(w http.ResponseWriter, r *http.Request) {
+	var hash Hash
+	if err := parseHex(r.URL.Query().Get("hash"), hash[:]); err != nil {
+		http.Error(w, fmt.Sprintf("invalid hash: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	proof, err := pm.VerifyTransaction(hash)
+	if err != nil {
+		writeProofError(w, err)
+		return
+	}
+	writeJSON(w, proof)
+}
+
+// rpcAccount proves the state of the account with the key query parameter, asking full nodes if we are a light client.
+func (pm *PeerManager) rpcAccount(w http.ResponseWriter, r *http.Request) {
+	var key PublicKey
+	if err := parseHex(r.URL.Query().Get("key"), key[:]); err != nil {
+		http.Error(w, fmt.Sprintf("invalid key: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	proof, err := pm.VerifyAccount(key)
+	if err != nil {
+		writeProofError(w, err)
+		return
+	}
+	writeJSON(w, proof)
+}
+
+type WalletActivity struct {
+	Height       uint64        // This is the height of the block.
+	BlockHash    Hash          // This is the hash of the block.
+	Transactions []Transaction // These are the block's transactions to or from the scanned keys.
+}
+
+// rpcFilters lists our block filters from the start query parameter on, MaxFilters at most.
+func (pm *PeerManager) rpcFilters(w http.ResponseWriter, r *http.Request) {
+	start, err := parseHeight(r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid start: %v", err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, pm.Chain.FiltersFrom(start, Hash{}, MaxFilters))
+}
+
+// rpcScan lists the transactions to or from the key query parameters, which may be repeated,
+// in the blocks from the from query parameter on. A light client finds them through block filters.
+func (pm *PeerManager) rpcScan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	keys := make([]PublicKey, len(query["key"]))
+	for i, s := range query["key"] {
+		if err := parseHex(s, keys[i][:]); err != nil {
+			http.Error(w, fmt.Sprintf("invalid key: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(keys) == 0 {
+		http.Error(w, "no key to scan for", http.StatusBadRequest)
+		return
+	}
+	from, err := parseHeight(query.Get("from"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	blocks, err := pm.ScanFilters(keys, from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	wanted := make(map[PublicKey]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	activity := make([]WalletActivity, 0, len(blocks))
+	for _, block := range blocks {
+		txs := make([]Transaction, 0)
+		for _, tx := range block.Transactions {
+			if wanted[tx.Sender] || wanted[tx.Recipient] {
+				txs = append(txs, tx)
+			}
+		}
+		// A filter can match by chance, in which case there is nothing to report
+		if len(txs) > 0 {
+			activity = append(activity, WalletActivity{Height: block.Height, BlockHash: block.BlockHash, Transactions: txs})
+		}
+	}
+	writeJSON(w, activity)
+}
+
+type AuthorityVotes struct {
+	Vote   AuthorityVote // This is the change voted for.
+	Voters []PublicKey   // These are the authorities that voted for it.
+}
+
+type AuthoritySet struct {
+	Authorities []Authority      // These are the authorities that may issue blocks, in schedule order.
+	Votes       []AuthorityVotes // These are the changes that have votes but not yet a majority.
+}
+
+// AuthorityVoteRequest asks us to vote for a key to have a weight.
+type AuthorityVoteRequest struct {
+	Key    string // This is the hex key the vote is about.
+	Weight uint64 // This is the weight we should vote for the key to have, 0 to remove it from the authority set.
+}
+
+// rpcAuthorities lists the authority set of a proof of authority chain and its open votes on GET. On POST it has
+// us vote in our blocks for the AuthorityVoteRequest in the JSON body. The body must be sent as application/json,
+// which a browser won't do across origins without asking first.
+func (pm *PeerManager) rpcAuthorities(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authorities, votes, err := pm.Chain.Authorities()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		set := AuthoritySet{Authorities: authorities, Votes: make([]AuthorityVotes, 0, len(votes))}
+		for vote, voters := range votes {
+			set.Votes = append(set.Votes, AuthorityVotes{Vote: vote, Voters: voters})
+		}
+		writeJSON(w, set)
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "vote must be sent as application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var request AuthorityVoteRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, MaxRPCBodySize)).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid vote: %v", err), http.StatusBadRequest)
+			return
+		}
+		vote := AuthorityVote{Weight: request.Weight}
+		if err := parseHex(request.Key, vote.Key[:]); err != nil {
+			http.Error(w, fmt.Sprintf("invalid key: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := pm.Chain.ProposeAuthority(vote); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, vote)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseHeight parses a block height query parameter, where empty means 1.
+func parseHeight(s string) (uint64, error) {
+	if s == "" {
+		return 1, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func writeProofError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, ErrProofNotFound) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// parseHex decodes s, which must be exactly len(out) bytes of hex, into out.
+func parseHex(s string, out []byte) error {
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(out) {
+		return fmt.Errorf("expected %d bytes, got %d", len(out), len(decoded))
+	}
+	copy(out, decoded)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Log(ERROR, fmt.Sprintf("failed to write RPC response: %v", err))
+	}
+}
+
+// runAdminCommand runs a command against the admin RPC of a running node and returns the process exit code.
+func runAdminCommand(args []string) int {
+	if rpcAddress == "" {
+		fmt.Fprintln(os.Stderr, "admin commands need the -rpc address of a running node")
+		return 2
+	}
+
+	var err error
+	switch {
+	case args[0] == "bans" && len(args) == 1:
+		err = adminListBans()
+	case args[0] == "unban" && len(args) == 2:
+		err = adminClearBans(args[1])
+	case args[0] == "sync" && len(args) == 1:
+		err = adminSyncStatus()
+	case args[0] == "tx" && len(args) == 2:
+		err = adminVerifyTx(args[1])
+	case args[0] == "account" && len(args) == 2:
+		err = adminVerifyAccount(args[1])
+	case args[0] == "scan" && (len(args) == 2 || len(args) == 3):
+		err = adminScan(args[1], args[2:])
+	case args[0] == "authorities" && len(args) == 1:
+		err = adminListAuthorities()
+	case args[0] == "vote" && len(args) == 3:
+		err = adminVote(args[1], args[2])
+	default:
+		fmt.Fprintln(os.Stderr, "usage: node [flags] bans")
+		fmt.Fprintln(os.Stderr, "       node [flags] unban <ip|all>")
+		fmt.Fprintln(os.Stderr, "       node [flags] sync")
+		fmt.Fprintln(os.Stderr, "       node [flags] tx <hash>")
+		fmt.Fprintln(os.Stderr, "       node [flags] account <key>")
+		fmt.Fprintln(os.Stderr, "       node [flags] scan <key> [from height]")
+		fmt.Fprintln(os.Stderr, "       node [flags] authorities")
+		fmt.Fprintln(os.Stderr, "       node [flags] vote <key> <weight>")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func adminListBans() error {
+	var bans []Ban
+	if err := adminRequest(http.MethodGet, "/bans", nil, &bans); err != nil {
+		return err
+	}
+
+	if len(bans) == 0 {
+		fmt.Println("no active bans")
+		return nil
+	}
+	for _, ban := range bans {
+		fmt.Printf("%-40s %-14s until %s\n", ban.Address, ban.Reason, ban.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func adminClearBans(address string) error {
+	path := "/bans"
+	if address != "all" {
+		path += "?address=" + url.QueryEscape(address)
+	}
+
+	var result map[string]int
+	if err := adminRequest(http.MethodDelete, path, nil, &result); err != nil {
+		return err
+	}
+	fmt.Printf("lifted %d ban(s)\n", result["Cleared"])
+	return nil
+}
+
+func adminSyncStatus() error {
+	var status SyncStatus
+	if err := adminRequest(http.MethodGet, "/sync", nil, &status); err != nil {
+		return err
+	}
+
+	if !status.Syncing {
+		fmt.Printf("not syncing, chain height %d\n", status.Height)
+		return nil
+	}
+	fmt.Printf("syncing from peer %s: block %d of %d (%.1f%%)\n", status.Peer, status.Height, status.TargetHeight, status.Percent)
+	return nil
+}
+
+func adminVerifyTx(hash string) error {
+	var proof TxProof
+	if err := adminRequest(http.MethodGet, "/tx?hash="+url.QueryEscape(hash), nil, &proof); err != nil {
+		return err
+	}
+
+	tx := proof.Transaction
+	fmt.Printf("transaction %x is in block %d (%x)\n", tx.TxHash, proof.Height, proof.BlockHash)
+	fmt.Printf("%d sent from %x to %x with fee %d\n", tx.Amount, tx.Sender, tx.Recipient, tx.TxFee)
+	return nil
+}
+
+func adminVerifyAccount(key string) error {
+	var proof AccountProof
+	if err := adminRequest(http.MethodGet, "/account?key="+url.QueryEscape(key), nil, &proof); err != nil {
+		return err
+	}
+
+	account := proof.Account
+	fmt.Printf("account %x as of block %d (%x)\n", account.Key, proof.Height, proof.BlockHash)
+	fmt.Printf("received %d, sent %d in %d transaction(s)\n", account.Received, account.Sent, account.Transactions)
+	return nil
+}
+
+func adminScan(key string, from []string) error {
+	path := "/scan?key=" + url.QueryEscape(key)
+	if len(from) > 0 {
+		path += "&from=" + url.QueryEscape(from[0])
+	}
+
+	var activity []WalletActivity
+	if err := adminRequest(http.MethodGet, path, nil, &activity); err != nil {
+		return err
+	}
+
+	if len(activity) == 0 {
+		fmt.Println("no transactions found")
+		return nil
+	}
+	for _, block := range activity {
+		for _, tx := range block.Transactions {
+			fmt.Printf("block %-8d %x: %d from %x to %x\n", block.Height, tx.TxHash, tx.Amount, tx.Sender, tx.Recipient)
+		}
+	}
+	return nil
+}
+
+func adminListAuthorities() error {
+	var set AuthoritySet
+	if err := adminRequest(http.MethodGet, "/authorities", nil, &set); err != nil {
+		return err
+	}
+
+	for _, authority := range set.Authorities {
+		fmt.Printf("authority %x weight %d\n", authority.Key, authority.Weight)
+	}
+	for _, votes := range set.Votes {
+		fmt.Printf("%d vote(s) for %x to have weight %d\n", len(votes.Voters), votes.Vote.Key, votes.Vote.Weight)
+	}
+	return nil
+}
+
+func adminVote(key string, weight string) error {
+	request := AuthorityVoteRequest{Key: key}
+	var err error
+	if request.Weight, err = strconv.ParseUint(weight, 10, 64); err != nil {
+		return fmt.Errorf("invalid weight: %w", err)
+	}
+
+	var vote AuthorityVote
+	if err := adminRequest(http.MethodPost, "/authorities", request, &vote); err != nil {
+		return err
+	}
+	fmt.Printf("voting for %x to have weight %d in the blocks we issue\n", vote.Key, vote.Weight)
+	return nil
+}
+
+// adminRequest calls the admin RPC with body, if not nil, as JSON and decodes its JSON response into v.
+// The cookie of the running node is sent along, which requests that change anything need.
+func adminRequest(method, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, "http://"+rpcAddress+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if cookie, err := os.ReadFile(RPCCookieFilename); err == nil {
+		request.Header.Set("Authorization", "Bearer "+string(cookie))
+	} else if method != http.MethodGet {
+		return fmt.Errorf("failed to read the admin RPC cookie: %w", err)
+	}
+
+	client := &http.Client{Timeout: RequestTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("%s: %s", response.Status, body)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
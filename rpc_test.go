@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRPCGuard(t *testing.T) {
+	const address = "127.0.0.1:19877"
+	guard := rpcGuard(map[string]bool{address: true}, "secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name    string
+		method  string
+		host    string
+		headers map[string]string
+		status  int
+	}{
+		{"local read", http.MethodGet, address, nil, http.StatusOK},
+		{"rebound host", http.MethodGet, "attacker.example:19877", nil, http.StatusForbidden},
+		{"foreign origin", http.MethodGet, address, map[string]string{"Origin": "http://attacker.example"}, http.StatusForbidden},
+		{"write without cookie", http.MethodPost, address, nil, http.StatusUnauthorized},
+		{"write with wrong cookie", http.MethodPost, address, map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"write with cookie", http.MethodPost, address, map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "http://"+test.host+"/authorities", nil)
+		for key, value := range test.headers {
+			request.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		guard.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+}
+
+func TestRPCVoteNeedsJSON(t *testing.T) {
+	pm := &PeerManager{Chain: initChain()}
+
+	// A form post is what a page on another origin can send without a preflight
+	request := httptest.NewRequest(http.MethodPost, "/authorities", strings.NewReader("key=00&weight=1"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	pm.rpcAuthorities(recorder, request)
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("got status %d for a form post, want %d", recorder.Code, http.StatusUnsupportedMediaType)
+	}
+}
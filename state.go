@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Hash commits to every field of the account, as a leaf of the state tree.
+func (a *Account) Hash() Hash {
+	h := sha256.New()
+
+	h.Write(a.Key[:])
+	binary.Write(h, binary.LittleEndian, a.Received)
+	binary.Write(h, binary.LittleEndian, a.Sent)
+	binary.Write(h, binary.LittleEndian, a.Transactions)
+
+	return Hash(sha256.Sum256(h.Sum(nil)))
+}
+
+// nextState returns the account state after block, leaving c.State as it was.
+// The caller must hold c.Mutex.
+func (c *Chain) nextState(block *Block) map[PublicKey]*Account {
+	state := make(map[PublicKey]*Account, len(c.State)+2*len(block.Transactions))
+	for key, account := range c.State {
+		state[key] = account
+	}
+	applyBlock(state, block)
+	return state
+}
+
+// applyBlock moves state on by block. Accounts the block touches are copied, so states that
+// shared an account before never share a changed one.
+func applyBlock(state map[PublicKey]*Account, block *Block) {
+	touched := make(map[PublicKey]bool)
+	account := func(key PublicKey) *Account {
+		if !touched[key] {
+			updated := Account{Key: key}
+			if existing, exists := state[key]; exists {
+				updated = *existing
+			}
+			state[key] = &updated
+			touched[key] = true
+		}
+		return state[key]
+	}
+
+	var fees uint64
+	for _, tx := range block.Transactions {
+		sender := account(tx.Sender)
+		sender.Sent += tx.Amount + tx.TxFee
+		sender.Transactions++
+		account(tx.Recipient).Received += tx.Amount
+		fees += tx.TxFee
+	}
+	if fees > 0 {
+		account(block.Issuer).Received += fees
+	}
+}
+
+// sortedAccounts returns the accounts of state in the order of the state tree, by key.
+func sortedAccounts(state map[PublicKey]*Account) []*Account {
+	accounts := make([]*Account, 0, len(state))
+	for _, account := range state {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return bytes.Compare(accounts[i].Key[:], accounts[j].Key[:]) < 0
+	})
+	return accounts
+}
+
+// StateRoot returns the Merkle root of state, which blocks from BlockVersionMerkle on commit to.
+func StateRoot(state map[PublicKey]*Account) Hash {
+	return MerkleRoot(accountHashes(sortedAccounts(state)))
+}
+
+func accountHashes(accounts []*Account) []Hash {
+	hashes := make([]Hash, len(accounts))
+	for i, account := range accounts {
+		hashes[i] = account.Hash()
+	}
+	return hashes
+}
+
+// appendBlock adds a block that has been checked to extend our tip, and moves the account state on to state,
+// which must be c.nextState(block). The caller must hold c.Mutex.
+func (c *Chain) appendBlock(block Block, state map[PublicKey]*Account) {
+	c.BlockHistory = append(c.BlockHistory, block)
+	c.State = state
+	for _, tx := range block.Transactions {
+		c.TxIndex[tx.TxHash] = block.Height
+	}
+	c.addFilter(&block)
+}
+
+// TxProof proves that the transaction with hash is in a block on our chain, or returns false if it isn't.
+func (c *Chain) TxProof(hash Hash) (*TxProof, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	height, exists := c.TxIndex[hash]
+	if !exists {
+		return nil, false
+	}
+	block := c.BlockHistory[height-1]
+	if block.Version < BlockVersionMerkle {
+		return nil, false
+	}
+
+	header := block.Header()
+	for i, tx := range block.Transactions {
+		if tx.TxHash == hash {
+			return &TxProof{
+				Height:      block.Height,
+				BlockHash:   block.BlockHash,
+				Index:       uint64(i),
+				Count:       uint64(len(header.TxHashes)),
+				Branch:      MerkleBranch(header.TxHashes, i),
+				Transaction: tx,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// AccountProof proves the state of the account with key as of our tip, or returns false if the account
+// has never been used or our tip doesn't commit to a StateRoot.
+func (c *Chain) AccountProof(key PublicKey) (*AccountProof, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if len(c.BlockHistory) == 0 {
+		return nil, false
+	}
+	tip := c.BlockHistory[len(c.BlockHistory)-1]
+	if tip.Version < BlockVersionMerkle {
+		return nil, false
+	}
+
+	accounts := sortedAccounts(c.State)
+	i := sort.Search(len(accounts), func(i int) bool {
+		return bytes.Compare(accounts[i].Key[:], key[:]) >= 0
+	})
+	if i == len(accounts) || accounts[i].Key != key {
+		return nil, false
+	}
+	return &AccountProof{
+		Height:    tip.Height,
+		BlockHash: tip.BlockHash,
+		Index:     uint64(i),
+		Count:     uint64(len(accounts)),
+		Branch:    MerkleBranch(accountHashes(accounts), i),
+		Account:   *accounts[i],
+	}, true
+}
+
+// Verify checks that the proof places its transaction in header, which must be the block it names.
+func (p *TxProof) Verify(header *BlockHeader) error {
+	if header.Version < BlockVersionMerkle {
+		return errors.New("block does not commit to a TxRoot")
+	}
+	if header.BlockHash != p.BlockHash || header.Height != p.Height {
+		return fmt.Errorf("proof is for block %x, not %x", p.BlockHash, header.BlockHash)
+	}
+	if err := p.Transaction.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+	}
+	if !VerifyMerkleBranch(p.Transaction.Hash(), p.Index, p.Count, p.Branch, header.TxRoot) {
+		return errors.New("transaction is not in the block's TxRoot")
+	}
+	return nil
+}
+
+// Verify checks that the proof places its account in the state committed to by header, which must be the block it names.
+func (p *AccountProof) Verify(header *BlockHeader) error {
+	if header.Version < BlockVersionMerkle {
+		return errors.New("block does not commit to a StateRoot")
+	}
+	if header.BlockHash != p.BlockHash || header.Height != p.Height {
+		return fmt.Errorf("proof is for block %x, not %x", p.BlockHash, header.BlockHash)
+	}
+	if !VerifyMerkleBranch(p.Account.Hash(), p.Index, p.Count, p.Branch, header.StateRoot) {
+		return errors.New("account is not in the block's StateRoot")
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewSyncState creates the progress tracker for our block download.
+func NewSyncState() *SyncState {
+	return &SyncState{
+		Mutex: new(sync.Mutex),
+		Wake:  make(chan struct{}, 1),
+	}
+}
+
+// Status returns our download progress against the chain at height.
+func (s *SyncState) Status(height uint64) SyncStatus {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	status := SyncStatus{
+		Syncing:      s.Syncing,
+		Peer:         s.Peer,
+		Downloaders:  s.Downloaders,
+		Height:       height,
+		StartHeight:  s.StartHeight,
+		TargetHeight: s.TargetHeight,
+		Percent:      100,
+	}
+	if s.Syncing && s.TargetHeight > s.StartHeight {
+		status.Percent = 100 * float64(height-s.StartHeight) / float64(s.TargetHeight-s.StartHeight)
+	}
+	return status
+}
+
+// requestSync wakes the sync loop if a peer has shown us it is ahead of our chain.
+func (pm *PeerManager) requestSync(p *Peer) {
+	if p.Height() <= pm.height() {
+		return
+	}
+	select {
+	case pm.Sync.Wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunSync downloads blocks, or only headers if we are a light client, whenever a peer is ahead of us, for as long as we run.
+func (pm *PeerManager) RunSync() {
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if pm.Light != nil {
+			pm.SyncLightChain()
+		} else {
+			pm.SyncChain()
+		}
+
+		select {
+		case <-pm.Context.Done():
+			return
+		case <-ticker.C:
+		case <-pm.Sync.Wake:
+		}
+	}
+}
+
+// SyncChain brings our chain up to date with our peers. The headers are downloaded from the fastest
+// peer that is ahead of us, then the blocks are fetched in parallel from every peer that has them.
+func (pm *PeerManager) SyncChain() {
+	failed := make(map[*Peer]bool)
+	for {
+		peer := pm.syncPeer(failed)
+		if peer == nil {
+			return
+		}
+
+		headers, err := pm.syncHeaders(peer)
+		if err != nil {
+			Log(WARNING, fmt.Sprintf("header download from peer %s failed: %v", peer.NodeID, err))
+			failed[peer] = true
+			continue
+		}
+		if len(headers) == 0 {
+			failed[peer] = true
+			continue
+		}
+
+		if err := pm.downloadBlocks(peer, headers); err != nil {
+			Log(WARNING, fmt.Sprintf("block download failed: %v", err))
+			return
+		}
+
+		// Blocks of a side chain with less work than ours leave us where we were
+		if pm.Chain.Height() < headers[len(headers)-1].Height {
+			failed[peer] = true
+		}
+	}
+}
+
+// syncPeer returns the lowest latency full node that is ahead of our chain, leaving out the peers in skip.
+func (pm *PeerManager) syncPeer(skip map[*Peer]bool) *Peer {
+	height := pm.height()
+	for _, peer := range pm.PeersByLatency() {
+		if !skip[peer] && peer.FullNode() && peer.Height() > height {
+			return peer
+		}
+	}
+	return nil
+}
+
+// syncHeaders downloads the headers that follow our chain tip from p and checks that they link up.
+func (pm *PeerManager) syncHeaders(p *Peer) ([]BlockHeader, error) {
+	height, parent := pm.Chain.Tip()
+	locator := pm.Chain.Locator()
+
+	headers := make([]BlockHeader, 0)
+	for {
+		batch, err := p.SendGetHeaders(&GetBlocksRequest{Locator: locator})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, header := range batch {
+			if err := header.Validate(); err != nil {
+				pm.Misbehaving(p, OffenseInvalidBlock, err.Error())
+				return nil, fmt.Errorf("header %d: %w", header.Height, err)
+			}
+			if len(headers) == 0 && pm.forksFromChain(&header) {
+				// The peer's chain left ours further back, and may have more work
+				height, parent = header.Height-1, header.ParentHash
+			}
+			if header.Height != height+1 || header.ParentHash != parent {
+				// We can't switch to a different chain, so there is nothing to download from this peer
+				return nil, fmt.Errorf("header %d does not extend our chain at height %d", header.Height, height)
+			}
+			headers = append(headers, header)
+			height, parent = header.Height, header.BlockHash
+		}
+		p.setHeight(height)
+
+		if len(batch) < MaxHeaders {
+			return headers, nil
+		}
+		locator = []Hash{parent}
+		Log(INFO, fmt.Sprintf("downloaded headers up to %d from peer %s", height, p.NodeID))
+	}
+}
+
+// forksFromChain reports whether header may start a side chain, leaving our chain at its parent
+// no more than MaxForkDepth blocks below our tip.
+func (pm *PeerManager) forksFromChain(header *BlockHeader) bool {
+	if !pm.Chain.AllowsForks() || header.Height == 0 {
+		return false
+	}
+	height := pm.Chain.Height()
+	if header.Height-1 > height || height-(header.Height-1) > MaxForkDepth {
+		return false
+	}
+	return header.Height == 1 && header.ParentHash == (Hash{}) || pm.Chain.HasBlock(header.Height-1, header.ParentHash)
+}
+
+// downloadBlocks fetches the blocks for headers from every peer that has them, BlockBatchSize at a time.
+// Blocks may arrive in any order but are added to the chain in order. Ranges that fail because a peer
+// disconnected, timed out or stalled the download window are requested again from another peer.
+func (pm *PeerManager) downloadBlocks(headerPeer *Peer, headers []BlockHeader) error {
+	startHeight := headers[0].Height - 1
+	targetHeight := headers[len(headers)-1].Height
+
+	pm.Sync.Mutex.Lock()
+	pm.Sync.Syncing = true
+	pm.Sync.Peer = headerPeer.NodeID
+	pm.Sync.Downloaders = 0
+	pm.Sync.StartHeight = startHeight
+	pm.Sync.TargetHeight = targetHeight
+	pm.Sync.Started = time.Now()
+	pm.Sync.Mutex.Unlock()
+
+	defer func() {
+		pm.Sync.Mutex.Lock()
+		pm.Sync.Syncing = false
+		pm.Sync.Downloaders = 0
+		pm.Sync.Mutex.Unlock()
+	}()
+
+	Log(INFO, fmt.Sprintf("downloading blocks %d to %d", headers[0].Height, targetHeight))
+
+	queue := make([]BlockRange, 0, len(headers)/BlockBatchSize+1)
+	for start := 0; start < len(headers); start += BlockBatchSize {
+		end := start + BlockBatchSize
+		if end > len(headers) {
+			end = len(headers)
+		}
+		queue = append(queue, BlockRange{Start: start, End: end})
+	}
+
+	results := make(chan *BlockFetch)
+	stop := make(chan struct{})
+	defer close(stop)
+	inFlight := make(map[*Peer]*BlockFetch)
+	failed := make(map[*Peer]bool)
+	received := make(map[int]Block)
+	next := 0
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for next < len(headers) {
+		// Hand out ranges inside the window to every idle peer that has them
+		for _, peer := range pm.PeersByLatency() {
+			if len(queue) == 0 || queue[0].Start >= next+BlockDownloadWindow {
+				break
+			}
+			if inFlight[peer] != nil || failed[peer] || !peer.FullNode() || peer.Height() < headers[queue[0].End-1].Height {
+				continue
+			}
+			fetch := &BlockFetch{Peer: peer, Range: queue[0], Sent: time.Now()}
+			queue = queue[1:]
+			inFlight[peer] = fetch
+			go fetchBlocks(fetch, headers, results, stop)
+		}
+
+		pm.Sync.Mutex.Lock()
+		pm.Sync.Downloaders = len(inFlight)
+		pm.Sync.Mutex.Unlock()
+
+		if len(inFlight) == 0 {
+			return fmt.Errorf("no peers left to download blocks %d to %d from", headers[next].Height, targetHeight)
+		}
+
+		select {
+		case fetch := <-results:
+			delete(inFlight, fetch.Peer)
+			accepted := pm.checkFetchedBlocks(fetch, headers, headerPeer)
+			for i, block := range accepted {
+				received[fetch.Range.Start+i] = block
+			}
+			if rest := (BlockRange{Start: fetch.Range.Start + len(accepted), End: fetch.Range.End}); rest.Start < rest.End {
+				queue = requeue(queue, rest)
+			}
+			if fetch.Err != nil {
+				failed[fetch.Peer] = true
+			}
+
+		case <-ticker.C:
+			pm.checkStalledDownload(inFlight, headers, next)
+			continue
+		}
+
+		// Add whatever is now next in line to the chain
+		committed := next
+		for {
+			block, exists := received[next]
+			if !exists {
+				break
+			}
+			delete(received, next)
+			if err := pm.addSyncedBlock(block); err != nil {
+				return err
+			}
+			next++
+		}
+		if next > committed {
+			status := pm.Sync.Status(pm.Chain.Height())
+			Log(INFO, fmt.Sprintf("downloaded block %d of %d (%.1f%%), downloading from %d peer(s)", status.Height, status.TargetHeight, status.Percent, status.Downloaders))
+		}
+	}
+
+	Log(INFO, fmt.Sprintf("caught up at height %d", pm.Chain.Height()))
+	return nil
+}
+
+// fetchBlocks requests a range of blocks from a peer and sends the outcome to results, unless the download has been stopped.
+func fetchBlocks(fetch *BlockFetch, headers []BlockHeader, results chan<- *BlockFetch, stop <-chan struct{}) {
+	request := &GetBlocksRequest{
+		Locator: []Hash{headers[fetch.Range.Start].ParentHash},
+		Stop:    headers[fetch.Range.End-1].BlockHash,
+	}
+
+	fetch.Blocks, fetch.Err = fetch.Peer.SendGetBlocks(request)
+	select {
+	case results <- fetch:
+	case <-stop:
+	}
+}
+
+// checkFetchedBlocks returns the leading blocks of a fetch that match the headers they were requested for.
+// A peer other than headerPeer that sends a different block may just be on another branch, so the range
+// fails without a penalty. A block that claims the hash of its header but doesn't match it, or any mismatch
+// from headerPeer, which sent us those headers itself, is penalized.
+func (pm *PeerManager) checkFetchedBlocks(fetch *BlockFetch, headers []BlockHeader, headerPeer *Peer) []Block {
+	if fetch.Err != nil {
+		Log(DEBUG, fmt.Sprintf("failed to fetch blocks from peer %s: %v", fetch.Peer.NodeID, fetch.Err))
+		return nil
+	}
+
+	count := fetch.Range.End - fetch.Range.Start
+	if len(fetch.Blocks) < count {
+		count = len(fetch.Blocks)
+	}
+	for i := 0; i < count; i++ {
+		block := &fetch.Blocks[i]
+		header := headers[fetch.Range.Start+i]
+		if block.BlockHash != header.BlockHash && fetch.Peer != headerPeer {
+			Log(DEBUG, fmt.Sprintf("peer %s sent block %d of another branch", fetch.Peer.NodeID, header.Height))
+			fetch.Err = errors.New("block is not the one of its header")
+			return fetch.Blocks[:i]
+		}
+		if block.BlockHash != header.BlockHash || block.Hash() != header.BlockHash || block.Validate() != nil {
+			pm.Misbehaving(fetch.Peer, OffenseInvalidBlock, fmt.Sprintf("block %d does not match its header", header.Height))
+			fetch.Err = errors.New("block does not match its header")
+			return fetch.Blocks[:i]
+		}
+	}
+	if count == 0 {
+		fetch.Err = errors.New("peer sent no blocks")
+	}
+	return fetch.Blocks[:count]
+}
+
+// checkStalledDownload disconnects the peer holding the next block we need if it has kept the
+// download window from moving for BlockStallTimeout while other peers could have taken over.
+func (pm *PeerManager) checkStalledDownload(inFlight map[*Peer]*BlockFetch, headers []BlockHeader, next int) {
+	for peer, fetch := range inFlight {
+		if fetch.Range.Start > next || fetch.Range.End <= next {
+			continue
+		}
+		if time.Since(fetch.Sent) < BlockStallTimeout || len(inFlight) >= pm.PeerCount() {
+			return
+		}
+		Log(WARNING, fmt.Sprintf("peer %s is stalling the block download at %d, disconnecting", peer.NodeID, headers[next].Height))
+		peer.Close()
+		return
+	}
+}
+
+// addSyncedBlock adds a downloaded block to the chain. A block that gossip already added is skipped.
+func (pm *PeerManager) addSyncedBlock(block Block) error {
+	pm.Seen.Add(block.BlockHash)
+	if err := pm.Chain.AddBlock(block); err != nil {
+		if height, _ := pm.Chain.Tip(); block.Height <= height && pm.Chain.HasBlock(block.Height, block.BlockHash) {
+			return nil
+		}
+		return fmt.Errorf("block %d: %w", block.Height, err)
+	}
+	return nil
+}
+
+// requeue puts a range back into the download queue, keeping the queue sorted so the oldest blocks go first.
+func requeue(queue []BlockRange, r BlockRange) []BlockRange {
+	i := sort.Search(len(queue), func(i int) bool {
+		return queue[i].Start > r.Start
+	})
+	queue = append(queue, BlockRange{})
+	copy(queue[i+1:], queue[i:])
+	queue[i] = r
+	return queue
+}
+
+// handleGetBlocks answers with the blocks that follow the last locator block we have in common with the requester.
+func (pm *PeerManager) handleGetBlocks(p *Peer, message *Message) {
+	if message.GetBlocks == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetBlocks without a body")
+		return
+	}
+
+	response := &Message{
+		Type:   MessageTypeBlocks,
+		Blocks: pm.Chain.BlocksAfter(message.GetBlocks.Locator, message.GetBlocks.Stop, MaxSyncBatch),
+	}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send blocks to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// handleGetHeaders answers with the headers that follow the last locator block we have in common with the requester.
+// Light clients get the headers that commit to a TxRoot without their TxHashes.
+func (pm *PeerManager) handleGetHeaders(p *Peer, message *Message) {
+	if message.GetBlocks == nil {
+		pm.Misbehaving(p, OffenseMalformedMessage, "GetHeaders without a body")
+		return
+	}
+
+	headers := pm.Chain.HeadersAfter(message.GetBlocks.Locator, message.GetBlocks.Stop, MaxHeaders)
+	if message.GetBlocks.Light {
+		for i := range headers {
+			if headers[i].Version >= BlockVersionMerkle {
+				headers[i].TxHashes = nil
+			}
+		}
+	}
+	response := &Message{
+		Type:    MessageTypeHeaders,
+		Headers: headers,
+	}
+	if err := p.Reply(message, response); err != nil {
+		Log(ERROR, fmt.Sprintf("Failed to send headers to peer %s: %v", p.NodeID, err))
+	}
+}
+
+// SendGetBlocks asks the peer for the blocks that follow our locator.
+func (p *Peer) SendGetBlocks(request *GetBlocksRequest) ([]Block, error) {
+	response, err := p.Request(&Message{Type: MessageTypeGetBlocks, GetBlocks: request})
+	if err != nil {
+		return nil, err
+	}
+	if response.Type != MessageTypeBlocks {
+		return nil, fmt.Errorf("unexpected message type received: %v", response.Type)
+	}
+	return response.Blocks, nil
+}
+
+// SendGetHeaders asks the peer for the headers that follow our locator.
+func (p *Peer) SendGetHeaders(request *GetBlocksRequest) ([]BlockHeader, error) {
+	response, err := p.Request(&Message{Type: MessageTypeGetHeaders, GetBlocks: request})
+	if err != nil {
+		return nil, err
+	}
+	if response.Type != MessageTypeHeaders {
+		return nil, fmt.Errorf("unexpected message type received: %v", response.Type)
+	}
+	return response.Headers, nil
+}
+
+// Height returns the highest block height the peer has shown us it has.
+func (p *Peer) Height() uint64 {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	return p.height
+}
+
+// setHeight records that the peer has a block at height.
+func (p *Peer) setHeight(height uint64) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	if height > p.height {
+		p.height = height
+	}
+}
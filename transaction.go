@@ -12,6 +12,10 @@ func (t *Transaction) Validate() error {
 	// Compute the hash of the transaction
 	txHash := t.Hash()
 
+	if t.TxHash != txHash {
+		return errors.New("transaction hash does not match transaction contents")
+	}
+
 	// Verify the signature of the transaction
 	if !ed25519.Verify(ed25519.PublicKey(t.Sender[:]), txHash[:], t.Signature[:]) {
 		return errors.New("transaction signature is invalid")
@@ -61,8 +65,9 @@ func (t *Transaction) Sign(key PrivateKey) error {
 		return errors.New("signature generation failed")
 	}
 
-	// Copy the signature into the transaction
+	// Copy the signature and hash into the transaction
 	copy(t.Signature[:], signature)
+	t.TxHash = txHash
 
 	return nil
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrConnectionRefused = errors.New("connection refused")
+
+func (TCPTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// NewMemoryNetwork creates an empty in-memory network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		Mutex:     new(sync.Mutex),
+		Listeners: make(map[string]*memoryListener),
+		nextPort:  49151,
+	}
+}
+
+// Host attaches a node with ip to the network.
+func (n *MemoryNetwork) Host(ip net.IP) *MemoryTransport {
+	return &MemoryTransport{Network: n, IP: ip}
+}
+
+// Listen binds to address on the node's IP. An empty host means the node's IP and port 0 picks a free port.
+func (t *MemoryTransport) Listen(address string) (net.Listener, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" && !net.ParseIP(host).Equal(t.IP) {
+		return nil, fmt.Errorf("can't listen on %s from %s", host, t.IP)
+	}
+	listenPort, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+
+	n := t.Network
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	if listenPort == 0 {
+		listenPort = n.freePortLocked()
+	}
+	addr := &net.TCPAddr{IP: t.IP, Port: listenPort}
+	if _, exists := n.Listeners[addr.String()]; exists {
+		return nil, fmt.Errorf("%s is already in use", addr)
+	}
+
+	listener := &memoryListener{
+		network: n,
+		addr:    addr,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.Listeners[addr.String()] = listener
+	return listener, nil
+}
+
+// Dial connects to a listener on the network, from an ephemeral port on the node's IP.
+func (t *MemoryTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	n := t.Network
+	n.Mutex.Lock()
+	listener, exists := n.Listeners[address]
+	local := &net.TCPAddr{IP: t.IP, Port: n.freePortLocked()}
+	n.Mutex.Unlock()
+
+	if !exists {
+		return nil, &net.OpError{Op: "dial", Net: "memory", Err: ErrConnectionRefused}
+	}
+
+	// Each direction is buffered like a socket, so two nodes writing to each other at once can't deadlock
+	toServer, toClient := newMemoryPipe(), newMemoryPipe()
+	server := &memoryConn{in: toServer, out: toClient, local: listener.addr, remote: local}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case listener.conns <- server:
+		return &memoryConn{in: toClient, out: toServer, local: local, remote: listener.addr}, nil
+	case <-listener.done:
+	case <-timer.C:
+	}
+	return nil, &net.OpError{Op: "dial", Net: "memory", Err: ErrConnectionRefused}
+}
+
+// freePortLocked hands out the next port. The caller must hold n.Mutex.
+func (n *MemoryNetwork) freePortLocked() int {
+	n.nextPort++
+	if n.nextPort > 65535 {
+		n.nextPort = 49152
+	}
+	return n.nextPort
+}
+
+// memoryListener accepts the connections dialed to its address on a MemoryNetwork.
+type memoryListener struct {
+	network   *MemoryNetwork
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.Mutex.Lock()
+		delete(l.network.Listeners, l.addr.String())
+		l.network.Mutex.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryPipe carries the bytes of one direction of an in-memory connection.
+// Writes never block, as if the socket buffers were unlimited.
+type memoryPipe struct {
+	mutex        sync.Mutex
+	data         []byte
+	writerClosed bool          // This is set once the writer closes. The reader gets io.EOF after draining data.
+	readerClosed bool          // This is set once the reader closes. Nothing more can be read or written.
+	deadline     time.Time     // This is the reader's deadline, or zero for none.
+	ready        chan struct{} // This is signalled whenever any of the above changes.
+}
+
+func newMemoryPipe() *memoryPipe {
+	return &memoryPipe{ready: make(chan struct{}, 1)}
+}
+
+// signal wakes the reader, if it is waiting.
+func (p *memoryPipe) signal() {
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// memoryConn is one end of an in-memory connection. It reports TCP addresses so
+// the rest of the node can't tell it apart from a real socket.
+type memoryConn struct {
+	in     *memoryPipe
+	out    *memoryPipe
+	local  *net.TCPAddr
+	remote *net.TCPAddr
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	for {
+		c.in.mutex.Lock()
+		switch {
+		case c.in.readerClosed:
+			c.in.mutex.Unlock()
+			return 0, net.ErrClosed
+		case len(c.in.data) > 0:
+			n := copy(b, c.in.data)
+			c.in.data = c.in.data[n:]
+			c.in.mutex.Unlock()
+			return n, nil
+		case c.in.writerClosed:
+			c.in.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := c.in.deadline
+		c.in.mutex.Unlock()
+
+		if deadline.IsZero() {
+			<-c.in.ready
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.in.ready:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	c.out.mutex.Lock()
+	defer c.out.mutex.Unlock()
+
+	if c.out.writerClosed || c.out.readerClosed {
+		return 0, io.ErrClosedPipe
+	}
+	c.out.data = append(c.out.data, b...)
+	c.out.signal()
+	return len(b), nil
+}
+
+func (c *memoryConn) Close() error {
+	c.in.mutex.Lock()
+	c.in.readerClosed = true
+	c.in.signal()
+	c.in.mutex.Unlock()
+
+	c.out.mutex.Lock()
+	c.out.writerClosed = true
+	c.out.signal()
+	c.out.mutex.Unlock()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.in.mutex.Lock()
+	c.in.deadline = t
+	c.in.signal()
+	c.in.mutex.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPeerManager creates a peer manager with a fresh chain for a node at ip and port, which is shut down with the test.
+func testPeerManager(t *testing.T, ip string, port uint16, transport Transport) *PeerManager {
+	t.Helper()
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	me := &Peer{NodeID: NodeIDFromKey(keys.PublicKey), PublicKey: keys.PublicKey, Address: net.ParseIP(ip), Port: port}
+	pm := NewPeerManager(me, *keys, initChain(), NewAddressBook(filepath.Join(dir, "peers.json")),
+		NewBanList(filepath.Join(dir, "bans.json")), transport)
+	t.Cleanup(pm.Shutdown)
+	return pm
+}
+
+// testNode starts a node that listens on ip of network.
+func testNode(t *testing.T, network *MemoryNetwork, ip string) *PeerManager {
+	t.Helper()
+	pm := testPeerManager(t, ip, 19876, network.Host(net.ParseIP(ip)))
+	if err := pm.Listen(fmt.Sprintf(":%d", pm.MyNode.Port)); err != nil {
+		t.Fatal(err)
+	}
+	return pm
+}
+
+// inTempDir runs the rest of the test in a temporary directory, where nodes that shut down save their chain.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// eventually polls condition until it holds, failing the test once timeout has passed.
+func eventually(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMemoryNetworkGossip(t *testing.T) {
+	// Transactions are announced at once rather than stemmed, which would only delay them here
+	defer func(stemmed bool) { noDandelion = stemmed }(noDandelion)
+	noDandelion = true
+	inTempDir(t)
+
+	network := NewMemoryNetwork()
+	var nodes []*PeerManager
+	for i := 1; i <= 4; i++ {
+		nodes = append(nodes, testNode(t, network, fmt.Sprintf("10.%d.0.1", i)))
+	}
+
+	// The nodes form a line, so that whatever reaches the last one was relayed by the others
+	for i := 1; i < len(nodes); i++ {
+		if _, err := nodes[i].ConnectToPeer(nodes[i-1].MyNode.Address, nodes[i-1].MyNode.Port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, node := range nodes {
+		expected := 2
+		if i == 0 || i == len(nodes)-1 {
+			expected = 1
+		}
+		eventually(t, 5*time.Second, fmt.Sprintf("node %d to have %d peers", i, expected), func() bool {
+			return node.Peers.Count() == expected
+		})
+	}
+
+	recipient, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := GenerateDemoTransactions(nodes[0].Keys, *recipient, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := txs[0]
+	if err := nodes[0].Chain.AddTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].BroadcastTransaction(&tx)
+	for i, node := range nodes {
+		eventually(t, 5*time.Second, fmt.Sprintf("the transaction to reach node %d", i), func() bool {
+			_, exists := node.Chain.PendingTransaction(tx.TxHash)
+			return exists
+		})
+	}
+
+	block, err := nodes[0].Chain.MineBlock(context.Background(), nodes[0].Keys.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].BroadcastBlock(block)
+	for i, node := range nodes {
+		eventually(t, 5*time.Second, fmt.Sprintf("the block to reach node %d", i), func() bool {
+			height, tip := node.Chain.Tip()
+			return height == block.Height && tip == block.BlockHash
+		})
+		if pending := node.Chain.Pending(); len(pending) != 0 {
+			t.Fatalf("node %d still has %d pending transaction(s) after the block confirmed them", i, len(pending))
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"math/big"
 	"net"
 	"os"
 	"sync"
@@ -8,7 +11,113 @@ import (
 )
 
 const (
-	KeysFilename = "keys.txt"
+	KeysFilename        = "keys.txt"
+	AddressBookFilename = "peers.json"
+	BanListFilename     = "bans.json"
+	AnchorsFilename     = "anchors.json"
+	ChainFilename       = "chain.json"
+	HeadersFilename     = "headers.json"
+	GenesisFilename     = "genesis.txt"
+	RPCCookieFilename   = "rpc.cookie"
+)
+
+const (
+	BlockVersionMerkle = 1 // Blocks from this version on commit to Merkle roots of their transactions and of the account state, rather than to every transaction hash.
+	BlockVersionWork   = 2 // Blocks from this version on also commit to a proof of work Target, which their hash must not exceed.
+)
+
+const (
+	DefaultBlockTime   = 30 * time.Second // This is the block interval proof of work difficulty is retargeted towards, unless -blocktime says otherwise.
+	RetargetInterval   = 20               // This is how many blocks pass between proof of work difficulty adjustments.
+	MaxRetargetFactor  = 4                // This is the most the difficulty changes by in one adjustment, either way.
+	MedianTimeBlocks   = 11               // This is how many recent blocks a new block's timestamp must be later than the median of.
+	MaxFutureBlockTime = 2 * time.Minute  // This is how far ahead of our clock a block's timestamp may be.
+	MaxForkDepth       = 100              // This is how many blocks back from our tip a competing chain may fork from.
+	MaxAuthorityWeight = 1000             // This is the most slots in a row one authority may be given in each round of the schedule.
+	MaxSlotDrift       = 2 * time.Second  // This is how far ahead of our clock a proof of authority block's timestamp may be.
+)
+
+// PowLimit is the easiest proof of work Target, which the first blocks of a chain start at.
+var PowLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 244), big.NewInt(1))
+
+const (
+	RequestTimeout = 5 * time.Second  // This is how long we wait for a peer to answer a request.
+	WriteTimeout   = 10 * time.Second // This is how long a single write to a peer may block before we treat the peer as dead.
+	PingInterval   = 30 * time.Second // This is how often we ping each peer.
+	IdleTimeout    = 90 * time.Second // This is how long a peer may stay silent before we disconnect it.
+	MaxPingMisses  = 3                // This is how many pings in a row may go unanswered before we disconnect the peer.
+	SeenCacheTTL   = 10 * time.Minute // This is how long a gossiped hash is remembered before it may be relayed again.
+	MaxPeerRecords = 100              // This is the most peer records we return in a single DiscoverPeersResponse.
+	PeerRecordTTL  = 24 * time.Hour   // This is how old a peer record may be before we stop trusting its address.
+)
+
+const (
+	NewBucketCount          = 64               // This is how many buckets hold addresses we have heard of but never connected to.
+	TriedBucketCount        = 16               // This is how many buckets hold addresses we have connected to.
+	BucketSize              = 32               // This is the most entries a single bucket may hold.
+	MaxAddressFailures      = 10               // This is how many failures in a row drop an address that never connected.
+	ReconnectBackoffBase    = 30 * time.Second // This is the delay after the first failed connection attempt.
+	ReconnectBackoffMax     = time.Hour        // This is the longest we wait between connection attempts.
+	AddressBookSaveInterval = time.Minute      // This is how often the address book is written to disk.
+	ConnectionCheckInterval = 10 * time.Second // This is roughly how often the connection manager tops up outbound slots.
+	DialJitter              = 2 * time.Second  // This is the most a dial is randomly delayed so peers don't redial in lockstep.
+	ShutdownTimeout         = 5 * time.Second  // This is how long each subsystem gets to stop when we shut down before we move on without it.
+)
+
+const (
+	BanThreshold         = 100 // This is the misbehavior score at which a peer's IP is banned.
+	PeerDownloadBurstSec = 4   // This is how many seconds of a peer's download quota it may send in one burst.
+	ScoreDecayPerHour    = 10  // This is how many points an IP's misbehavior score drops each hour.
+	DefaultBanDurationHr = 24  // This is how many hours a ban lasts unless -banduration says otherwise.
+)
+const (
+	MaxRPCBodySize = 64 * 1024 // This is the largest request body the admin RPC reads.
+)
+const (
+	SyncInterval = 30 * time.Second // This is how often we check whether a peer has blocks we are missing.
+	MaxSyncBatch = 1 << 20          // This is roughly how many bytes of blocks we send in answer to one GetBlocks request.
+	MaxHeaders   = 2000             // This is the most headers we send in answer to one GetHeaders request.
+	MaxFilters   = 1000             // This is the most block filters we send in answer to one GetFilters or GetFilterHeaders request.
+
+	BlockBatchSize      = 128             // This is how many blocks we ask a single peer for at once.
+	BlockDownloadWindow = 1024            // This is how far past our chain tip we download blocks before they can be added.
+	BlockStallTimeout   = 3 * time.Second // This is how long a peer may hold up the download window before we disconnect it.
+
+	ShortIDMask = 1<<48 - 1 // This keeps the low 48 bits of a hash as a compact block short ID.
+
+	InvInterval   = 500 * time.Millisecond // This is how often queued transaction announcements are sent to each peer.
+	MaxInvBatch   = 250                    // This is the most hashes in a single Inv or GetData message.
+	GetDataExpiry = 30 * time.Second       // This is how long we wait for an announced transaction before asking another peer for it.
+
+	MaxMempoolShortIDs = 100000 // This is the most short IDs of our pending pool we send when asking a new peer for theirs.
+	MempoolSyncRate    = 50     // This is how many pending transactions a second we announce to a peer that asked for our pool, well inside its default transaction rate limit.
+
+	MinAddressVotes = 4              // This is how many network groups must agree on our address before we advertise it.
+	AddressVoteTTL  = 24 * time.Hour // This is how long a network group's report of our address counts.
+
+	PeerEventBuffer = 64 // This is how many peer events a subscriber may fall behind by before events are dropped.
+
+	MaxAnchors = 2 // This is how many of our longest lived outbound peers we reconnect to first after a restart.
+)
+
+const (
+	DHTBucketCount     = 128              // This is how many buckets the routing table has, one per bit of a NodeID.
+	DHTBucketSize      = 16               // This is the most nodes a bucket holds, and how many nodes a lookup returns.
+	DHTAlpha           = 3                // This is how many nodes a lookup queries in parallel.
+	DHTRequestTimeout  = 2 * time.Second  // This is how long we wait for a UDP reply.
+	DHTRefreshInterval = 5 * time.Minute  // This is how often we check the routing table for stale buckets and dead nodes.
+	DHTBucketStale     = time.Hour        // This is how long a bucket may go without a lookup before we refresh it.
+	MaxDHTPacketSize   = 64 * 1024        // This is the largest UDP packet we read.
+	DHTSeedRetry       = 30 * time.Second // This is how long we wait before pinging our seeds again while our routing table is empty.
+)
+
+const (
+	DandelionDestinations = 2                // This is how many outbound peers we stem transactions to in each epoch.
+	DandelionEpoch        = 10 * time.Minute // This is how long we keep the same stem routes before choosing new ones.
+	FluffProbability      = 0.1              // This is the chance that a stem transaction we receive ends its stem with us.
+	EmbargoTimeout        = 30 * time.Second // This is the least time we wait for a stem transaction to be fluffed before we fluff it ourselves.
+	EmbargoJitter         = 15 * time.Second // This is the most extra time, picked at random, added to each embargo.
+	MaxStemPool           = 5000             // This is the most stem transactions we hold. Beyond it they are fluffed straight away.
 )
 
 const (
@@ -19,8 +128,6 @@ const (
 	CRITICAL
 )
 
-var GlobalPeers map[NodeID]*Peer = make(map[NodeID]*Peer)
-
 var (
 	logLevelNames = []string{
 		"DEBUG",
@@ -38,6 +145,97 @@ var MyNodeID NodeID
 var MyPublicKey PublicKey
 var port int
 
+var (
+	configFileName string        // This is the optional config file holding flag values.
+	seedsFileName  string        // This is the optional file listing bootstrap peers, one host:port per line.
+	genesisFile    string        // This is the file defining the first authority set and slot schedule of a proof of authority chain.
+	genesis        *Genesis      // This is the loaded genesis file, under -consensus poa.
+	bootstrapPeers []string      // These are the host:port addresses we bootstrap from.
+	staticPeers    []string      // These are the host:port addresses we always stay connected to.
+	noBootstrap    bool          // This disables outbound bootstrapping entirely.
+	maxOutbound    int           // This is how many outbound connections the connection manager keeps open.
+	maxInbound     int           // This is how many inbound connections we accept.
+	maxPerIP       int           // This is how many inbound connections we accept from a single IP.
+	maxPerSubnet   int           // This is how many inbound connections we accept from a single network group.
+	rpcAddress     string        // This is the local address the admin RPC server listens on.
+	banDuration    time.Duration // This is how long misbehaving peers are banned for.
+	maxDownloadKB  int           // This caps our total download rate in KB/s, 0 for no cap.
+	maxUploadKB    int           // This caps our total upload rate in KB/s, 0 for no cap.
+	peerDownloadKB int           // This is the download rate in KB/s a single peer may sustain before we disconnect it.
+	externalAddr   string        // This is the address we advertise to peers, overriding the one they report seeing.
+	lightMode      bool          // This runs a light client that keeps headers only.
+	consensusMode  string        // This is the consensus engine our chain follows: "signed", "pow" or "poa".
+	blockTime      time.Duration // This is the block interval proof of work difficulty is retargeted towards.
+	mine           bool          // This keeps mining our pending transactions into blocks.
+	minerThreads   int           // This is how many goroutines search for a proof of work nonce.
+	noDHT          bool          // This disables UDP peer discovery.
+	noDandelion    bool          // This broadcasts our transactions straight away instead of stemming them first.
+	dhtPort        int           // This is the UDP port peer discovery listens on, 0 for the same port as -port.
+	dhtSeeds       []string      // These are the host:port UDP addresses we join the discovery network through.
+)
+
+// Offense is a kind of peer misbehavior that we penalize.
+type Offense string
+
+const (
+	OffenseInvalidBlock       Offense = "invalidblock" // The peer sent a block that fails validation.
+	OffenseInvalidTransaction Offense = "invalidtx"    // The peer sent a transaction that fails validation.
+	OffenseBadRecord          Offense = "badrecord"    // The peer sent a peer record with a bad signature or identity.
+	OffenseMalformedMessage   Offense = "malformed"    // The peer sent a message we could not decode or that was missing its body.
+	OffenseFlooding           Offense = "flooding"     // The peer sent messages faster than their rate limit.
+	OffenseInvalidProof       Offense = "invalidproof" // The peer sent a Merkle proof that doesn't match our headers.
+)
+
+// Penalties are the misbehavior points charged for each offense. They can be changed with the -penalty flag.
+var Penalties = map[Offense]int{
+	OffenseInvalidBlock:       100,
+	OffenseInvalidTransaction: 20,
+	OffenseBadRecord:          50,
+	OffenseMalformedMessage:   50,
+	OffenseFlooding:           10,
+	OffenseInvalidProof:       100,
+}
+
+// RateLimit is a token bucket setting: Rate tokens are added each second, up to Burst.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// MessageRateLimits are the per-peer limits on how many messages of each type we handle. They can be changed with the -ratelimit flag.
+var MessageRateLimits = map[MessageType]RateLimit{
+	MessageTypeBlock:                 {Rate: 2, Burst: 20},
+	MessageTypeTransaction:           {Rate: 100, Burst: 500},
+	MessageTypeStemTransaction:       {Rate: 20, Burst: 100},
+	MessageTypeGetMempool:            {Rate: 0.01, Burst: 2},
+	MessageTypeDiscoverPeersRequest:  {Rate: 0.1, Burst: 3},
+	MessageTypeDiscoverPeersResponse: {Rate: 0.1, Burst: 3},
+	MessageTypeHelloRequest:          {Rate: 0.01, Burst: 2},
+	MessageTypeHelloResponse:         {Rate: 0.01, Burst: 2},
+	MessageTypePing:                  {Rate: 1, Burst: 5},
+	MessageTypeGetBlocks:             {Rate: 10, Burst: 50},
+	MessageTypeGetHeaders:            {Rate: 5, Burst: 20},
+	MessageTypeCompactBlock:          {Rate: 2, Burst: 20},
+	MessageTypeGetBlockTxs:           {Rate: 10, Burst: 50},
+	MessageTypeInv:                   {Rate: 10, Burst: 50},
+	MessageTypeGetData:               {Rate: 10, Burst: 50},
+	MessageTypePeerRecord:            {Rate: 0.01, Burst: 3},
+	MessageTypeGetTxProof:            {Rate: 5, Burst: 20},
+	MessageTypeGetAccountProof:       {Rate: 5, Burst: 20},
+	MessageTypeGetFilters:            {Rate: 2, Burst: 10},
+	MessageTypeGetFilterHeaders:      {Rate: 5, Burst: 20},
+}
+
+// DefaultMessageRateLimit applies to message types without an entry in MessageRateLimits.
+var DefaultMessageRateLimit = RateLimit{Rate: 20, Burst: 100}
+
+// DefaultBootstrapPeers are used when no bootstrap peers are configured.
+var DefaultBootstrapPeers = []string{
+	"170.64.168.154:19876",
+	"159.65.11.179:19876",
+	"165.22.9.57:19876",
+}
+
 type LogLevel int
 
 type NodeID string
@@ -50,6 +248,13 @@ type SuperBlock [100]Block
 
 type MessageType int
 
+// ServiceFlags describe what a node offers to its peers.
+type ServiceFlags uint64
+
+const (
+	ServiceFullNode ServiceFlags = 1 << iota // This node stores and serves the full chain.
+)
+
 const (
 	MessageTypeBlock MessageType = iota
 	MessageTypeTransaction
@@ -57,42 +262,439 @@ const (
 	MessageTypeDiscoverPeersResponse
 	MessageTypeHelloRequest
 	MessageTypeHelloResponse
+	MessageTypePing
+	MessageTypePong
+	MessageTypeGetBlocks
+	MessageTypeBlocks
+	MessageTypeGetHeaders
+	MessageTypeHeaders
+	MessageTypeCompactBlock
+	MessageTypeGetBlockTxs
+	MessageTypeBlockTxs
+	MessageTypeInv
+	MessageTypeGetData
+	MessageTypePeerRecord
+	MessageTypeGetTxProof
+	MessageTypeTxProof
+	MessageTypeGetAccountProof
+	MessageTypeAccountProof
+	MessageTypeGetFilters
+	MessageTypeGetFilterHeaders
+	MessageTypeFilters
+	MessageTypeStemTransaction
+	MessageTypeGetMempool
 )
 
+var messageTypeNames = map[MessageType]string{
+	MessageTypeBlock:                 "block",
+	MessageTypeTransaction:           "transaction",
+	MessageTypeDiscoverPeersRequest:  "discoverpeers",
+	MessageTypeDiscoverPeersResponse: "discoverpeersresponse",
+	MessageTypeHelloRequest:          "hello",
+	MessageTypeHelloResponse:         "helloresponse",
+	MessageTypePing:                  "ping",
+	MessageTypePong:                  "pong",
+	MessageTypeGetBlocks:             "getblocks",
+	MessageTypeBlocks:                "blocks",
+	MessageTypeGetHeaders:            "getheaders",
+	MessageTypeHeaders:               "headers",
+	MessageTypeCompactBlock:          "compactblock",
+	MessageTypeGetBlockTxs:           "getblocktxs",
+	MessageTypeBlockTxs:              "blocktxs",
+	MessageTypeInv:                   "inv",
+	MessageTypeGetData:               "getdata",
+	MessageTypePeerRecord:            "peerrecord",
+	MessageTypeGetTxProof:            "gettxproof",
+	MessageTypeTxProof:               "txproof",
+	MessageTypeGetAccountProof:       "getaccountproof",
+	MessageTypeAccountProof:          "accountproof",
+	MessageTypeGetFilters:            "getfilters",
+	MessageTypeGetFilterHeaders:      "getfilterheaders",
+	MessageTypeFilters:               "filters",
+	MessageTypeStemTransaction:       "stemtx",
+	MessageTypeGetMempool:            "getmempool",
+}
+
 type Message struct {
 	Type        MessageType
+	RequestID   uint64 // This is set by the sender when it expects a response.
+	ResponseTo  uint64 // This is the RequestID of the request this message answers.
 	Block       *Block
 	Transaction *Transaction
 	Request     *DiscoverPeersRequest
 	Response    *DiscoverPeersResponse
 	HelloReq    *HelloRequest
 	HelloRes    *HelloResponse
+	GetBlocks   *GetBlocksRequest   // This is the body of GetBlocks and GetHeaders requests.
+	Blocks      []Block             // These are the blocks answering a GetBlocks request.
+	Headers     []BlockHeader       // These are the headers answering a GetHeaders request.
+	Compact     *CompactBlock       // This is a block announced by its header and short transaction IDs.
+	GetBlockTxs *GetBlockTxsRequest // This asks for the transactions of a compact block we could not find in our pending pool.
+	BlockTxs    []Transaction       // These are the transactions answering a GetBlockTxs request.
+	Inv         []Hash              // These are the transaction hashes announced by an Inv or asked for by a GetData.
+	Record      *PeerRecord         // This is the sender's updated peer record.
+	Proof       *ProofRequest       // This asks for a TxProof or an AccountProof.
+	TxProof     *TxProof            // This answers a GetTxProof, or is nil if the transaction isn't on the chain.
+	Account     *AccountProof       // This answers a GetAccountProof, or is nil if the account has never been used.
+	GetFilters  *GetFiltersRequest  // This is the body of GetFilters and GetFilterHeaders requests.
+	Filters     []BlockFilter       // These answer a GetFilters request, or a GetFilterHeaders request without their Filter.
+	Mempool     *MempoolRequest     // This asks for Inv announcements of the pending transactions the sender doesn't have.
 }
 type HelloRequest struct {
-	NodeID    NodeID
-	PublicKey PublicKey
+	NodeID      NodeID
+	PublicKey   PublicKey
+	Record      *PeerRecord // This is the sender's own signed peer record.
+	Height      uint64      // This is the height of the sender's chain.
+	YourAddress net.IP      // This is the address the sender dialed to reach the receiver.
 }
 
 type HelloResponse struct {
-	NodeID    NodeID
-	PublicKey PublicKey
+	NodeID      NodeID
+	PublicKey   PublicKey
+	Record      *PeerRecord // This is the sender's own signed peer record.
+	Height      uint64      // This is the height of the sender's chain.
+	YourAddress net.IP      // This is the address the sender sees the receiver's connection coming from.
+}
+
+type GetBlocksRequest struct {
+	Locator []Hash // These are hashes of the requester's chain, newest first, used to find the last block we have in common.
+	Stop    Hash   // This is the last block wanted, or the zero hash for as many as fit in one response.
+	Light   bool   // This asks for headers without their TxHashes, where the header commits to them through its TxRoot.
+}
+
+type GetFiltersRequest struct {
+	StartHeight uint64 // This is the height of the first block whose filter is wanted.
+	Stop        Hash   // This is the last block whose filter is wanted, or the zero hash for as many as fit in one response.
+}
+
+type BlockFilter struct {
+	Height    uint64 // This is the height of the block the filter is for.
+	BlockHash Hash   // This is the hash of the block the filter is for.
+	Filter    []byte // This is the Golomb-coded set of the senders and recipients in the block.
+	Header    Hash   // This commits to the filter and to the header of the filter before it, chaining every filter up to this block.
+}
+
+type ProofRequest struct {
+	TxHash  Hash      // This is the transaction a GetTxProof asks about.
+	Account PublicKey // This is the account a GetAccountProof asks about.
+}
+
+type TxProof struct {
+	Height      uint64      // This is the height of the block holding the transaction.
+	BlockHash   Hash        // This is the hash of the block holding the transaction.
+	Index       uint64      // This is the transaction's position in the block.
+	Count       uint64      // This is how many transactions the block holds.
+	Branch      []Hash      // These are the Merkle tree hashes from the transaction up to the block's TxRoot.
+	Transaction Transaction // This is the transaction itself.
+}
+
+type Account struct {
+	Key          PublicKey // This is the account's public key.
+	Received     uint64    // This is the total the account has been sent, including fees of blocks it issued.
+	Sent         uint64    // This is the total the account has sent, including fees.
+	Transactions uint64    // This is how many transactions the account has sent.
+}
+
+type AccountProof struct {
+	Height    uint64  // This is the height of the block whose StateRoot the proof is against.
+	BlockHash Hash    // This is the hash of that block.
+	Index     uint64  // This is the account's position in the state tree.
+	Count     uint64  // This is how many accounts the state tree holds.
+	Branch    []Hash  // These are the Merkle tree hashes from the account up to the block's StateRoot.
+	Account   Account // This is the account's state as of the block.
+}
+
+type LightChain struct {
+	Mutex   *sync.Mutex   // This is a mutex to ensure consistency when headers arrive from several peers.
+	Path    string        // This is the file the headers are persisted to.
+	Headers []BlockHeader // These are the headers of the chain, without their TxHashes where the header commits to a TxRoot.
+}
+
+type PeerRecord struct {
+	NodeID    NodeID       // This is the peer's globally unique identifier.
+	PublicKey PublicKey    // This is the key the record is signed with.
+	Address   net.IP       // This is the IP address the peer can be reached on.
+	Port      uint16       // This is the port the peer listens on.
+	LastSeen  time.Time    // This is when the peer signed this record.
+	Services  ServiceFlags // These are the services the peer offers.
+	Signature Signature    // This is the peer's signature over the record.
+}
+
+// MessageHandler is called for every message from a peer that is not a response to one of our requests.
+type MessageHandler func(p *Peer, message *Message)
+
+// Transport opens the connections peers talk over. Addresses are host:port strings.
+type Transport interface {
+	Dial(address string, timeout time.Duration) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+// TCPTransport connects peers over real TCP sockets.
+type TCPTransport struct{}
+
+// MemoryNetwork connects peers within a single process over in-memory pipes, so whole networks of nodes can run in tests.
+type MemoryNetwork struct {
+	Mutex     *sync.Mutex                // This is a mutex to ensure consistency when nodes listen and dial concurrently.
+	Listeners map[string]*memoryListener // These are the open listeners, keyed by host:port.
+	nextPort  int                        // This is the last port handed out to a listener or dialer that didn't ask for one.
+}
+
+// MemoryTransport is a node's view of a MemoryNetwork. Its connections come from, and its listeners bind to, its IP.
+type MemoryTransport struct {
+	Network *MemoryNetwork // This is the network the node is attached to.
+	IP      net.IP         // This is the node's address on the network.
 }
+
 type Peer struct {
-	NodeID    NodeID    // This is a globally unique peer identifier.
-	Address   net.IP    // This is the IP address for this peer.
-	Port      uint16    // This is a port number for this peer.
-	PublicKey PublicKey // This is the public key associated with this peer.
-	Conn      net.Conn  // This is the TCP connection associated with this peer.
+	NodeID    NodeID         // This is a globally unique peer identifier.
+	Address   net.IP         // This is the IP address for this peer.
+	Port      uint16         // This is a port number for this peer.
+	PublicKey PublicKey      // This is the public key associated with this peer.
+	Conn      net.Conn       // This is the connection associated with this peer.
+	Handler   MessageHandler // This receives unsolicited messages read from Conn.
+	Record    *PeerRecord    // This is the peer's latest signed record. Once the peer is active it must be read with CurrentRecord.
+	Inbound   bool           // This is true if the peer dialed us.
+	Connected time.Time      // This is when the peer completed its handshake and became active.
+	Score     int            // This is the misbehavior score of this connection. It is guarded by the PeerManager's BanList.
+	Limits    *PeerLimits    // These are the rate limits and traffic counters of this connection.
+
+	decoder       *json.Decoder            // This decodes messages from Conn. It is only used by the handshake and then readLoop.
+	writeMutex    sync.Mutex               // This serializes writes to Conn.
+	pendingMutex  sync.Mutex               // This guards pending and nextRequestID.
+	pending       map[uint64]chan *Message // These are the callers waiting on a response, by RequestID.
+	nextRequestID uint64                   // This is the last RequestID we handed out.
+	done          chan struct{}            // This is closed once the connection has been shut down.
+	closeOnce     sync.Once                // This makes Close safe to call more than once.
+	statsMutex    sync.Mutex               // This guards latency, lastReceived, height and, once the peer is active, Record.
+	latency       time.Duration            // This is the smoothed round trip time of our pings, or 0 before the first pong.
+	lastReceived  time.Time                // This is when we last read a message from the peer.
+	height        uint64                   // This is the highest block height the peer has shown us it has.
+	known         *SeenCache               // These are the block and transaction hashes the peer is known to have.
+	invMutex      sync.Mutex               // This guards invQueue.
+	invQueue      []Hash                   // These are the transaction hashes waiting to be announced to the peer.
+}
+
+// PeerEventType says whether a PeerEvent is a connect or a disconnect.
+type PeerEventType int
+
+const (
+	PeerConnected    PeerEventType = iota // The peer completed its handshake and became active.
+	PeerDisconnected                      // The peer's connection closed or was replaced by a newer one.
+)
+
+type PeerEvent struct {
+	Type PeerEventType // This is what happened to the peer.
+	Peer *Peer         // This is the connection the event is about.
+}
+
+// DHTPacketType says what a DHTPacket asks for or answers.
+type DHTPacketType int
+
+const (
+	DHTPing      DHTPacketType = iota // The sender asks whether we are alive.
+	DHTPong                           // The answer to a DHTPing.
+	DHTFindNode                       // The sender asks for the nodes we know closest to Target.
+	DHTNeighbors                      // The answer to a DHTFindNode.
+)
+
+type DHTContact struct {
+	Record   PeerRecord // This is the node's latest signed record.
+	Endpoint string     // This is the host:port the node's discovery service was last reached on.
+}
+
+type DHTPacket struct {
+	Type        DHTPacketType // This is what the packet asks for or answers.
+	RequestID   uint64        // This identifies a request, so its reply can be matched to it.
+	ResponseTo  uint64        // This is the RequestID of the request a reply answers.
+	From        PeerRecord    // This is the sender's signed record.
+	YourAddress net.IP        // This is the IP the sender saw the request come from, set on replies.
+	Target      NodeID        // This is the NodeID a DHTFindNode looks for.
+	Nodes       []DHTContact  // These are the nodes a DHTNeighbors reply returns.
+	Signature   Signature     // This is the sender's signature over the packet.
+}
+
+type DHTNode struct {
+	Contact  DHTContact   // This is how to reach the node, and its record.
+	Addr     *net.UDPAddr // This is the resolved Endpoint.
+	LastSeen time.Time    // This is when we last heard from the node.
+}
+
+type DHTState struct {
+	Mutex         *sync.Mutex                // This is a mutex to ensure consistency when the routing table is updated from several packets.
+	Conn          net.PacketConn             // This is the UDP socket the discovery service runs on.
+	Self          NodeID                     // This is our own NodeID, which distances are measured from.
+	Buckets       [DHTBucketCount][]*DHTNode // These are the known nodes, by the bit length of their distance from us. Each bucket is ordered least recently seen first.
+	Refreshed     [DHTBucketCount]time.Time  // This is when each bucket was last looked up.
+	pending       map[uint64]dhtWaiter       // These are the requests waiting for a reply, by RequestID.
+	nextRequestID uint64                     // This is the last RequestID we handed out.
+	checking      map[NodeID]bool            // These are the nodes we are pinging to decide whether a newcomer can take their place.
 }
 
-type PeerList struct {
-	Peers map[NodeID]*Peer // This is a map representing our peer list.
+type PeerRegistry struct {
+	Mutex          *sync.Mutex            // This is a mutex to ensure consistency when peers connect and disconnect concurrently.
+	Peers          map[NodeID]*Peer       // These are the active peers, by NodeID.
+	Subscribers    map[int]chan PeerEvent // These receive an event whenever a peer connects or disconnects.
+	nextSubscriber int                    // This is the ID the next subscriber gets.
 }
 
 type PeerManager struct {
-	Peers  map[NodeID]*Peer // These are the managed active peers.
-	Mutex  *sync.Mutex      // This is a mutex to ensure consistency when managing our peer list.
-	MyNode *Peer            // This is our own peer information.
+	Peers   *PeerRegistry   // These are the managed active peers.
+	Mutex   *sync.Mutex     // This is a mutex to ensure consistency when managing Dialing, FromIP and FromNet.
+	MyNode  *Peer           // This is our own peer information.
+	Keys    KeyPair         // This is our node's signing key pair.
+	Chain   *Chain          // This is the chain that inbound blocks and transactions are fed into.
+	Seen    *SeenCache      // These are the block and transaction hashes we have already relayed.
+	Asked   *SeenCache      // These are the transaction hashes we have recently asked a peer for.
+	Book    *AddressBook    // These are the addresses we know of, including peers we are not connected to.
+	Dialing map[string]bool // These are the addresses with an outbound connection attempt in progress.
+	FromIP  map[string]int  // This counts our inbound connections, including those still in their handshake, by remote IP.
+	FromNet map[string]int  // This counts our inbound connections, including those still in their handshake, by network group.
+	Bans    *BanList        // These are the misbehavior scores and bans of remote IPs.
+	Limits  *GlobalLimits   // These are the bandwidth caps shared by all connections.
+	Metrics *Metrics        // These are our network traffic counters.
+	Sync    *SyncState      // This is the progress of our block download.
+	Address *AddressVotes   // These are the addresses our peers see us at. Its mutex also guards MyNode.Address and MyNode.Port.
+	Context context.Context // This is cancelled once we start shutting down. Nothing new is started after that.
+	Network Transport       // This is how we dial and accept peer connections.
+	DHT     *DHTState       // This is our UDP discovery service, or nil if it isn't running.
+	Light   *LightChain     // These are our headers if we are a light client, or nil if we are a full node.
+	Stem    *DandelionState // These are the transactions in their stem phase and the routes we stem them along.
+
+	cancel  context.CancelFunc // This cancels Context.
+	workers sync.WaitGroup     // These are the background loops that Shutdown waits for.
+}
+
+type AddressVote struct {
+	Address net.IP    // This is the address the peer saw us at.
+	Time    time.Time // This is when the peer told us.
+}
+
+type AddressVotes struct {
+	Mutex    *sync.Mutex            // This is a mutex to ensure consistency when votes arrive from several peers.
+	Votes    map[string]AddressVote // This is the latest address reported by a peer we reached ourselves, by the peer's NetworkGroup.
+	Override bool                   // This is true if our address was set with -externaladdr, so votes are ignored.
+}
+
+// DandelionState relays new transactions along a single random path of peers, the stem, before they are
+// broadcast to everyone, the fluff, so the timing of the broadcast doesn't give away the node they came from.
+type DandelionState struct {
+	Mutex        *sync.Mutex
+	Pool         map[Hash]*StemTransaction // These are the stem transactions we have relayed but not seen fluffed.
+	Destinations []*Peer                   // These are the outbound peers we stem to this epoch.
+	Routes       map[*Peer]*Peer           // This maps each peer we receive stem transactions from to the destination we pass them on to. Our own transactions use the nil key.
+	Epoch        time.Time                 // This is when the current destinations were chosen.
+}
+
+type StemTransaction struct {
+	Transaction Transaction // This is the transaction being stemmed.
+	Embargo     time.Time   // This is when we fluff the transaction ourselves if no one else has.
+}
+
+type SyncState struct {
+	Mutex        *sync.Mutex   // This is a mutex to ensure consistency when progress is read while syncing.
+	Wake         chan struct{} // This is signalled when a peer shows us it has blocks we don't.
+	Syncing      bool          // This is true while we are downloading blocks.
+	Peer         NodeID        // This is the peer we downloaded the headers from.
+	Downloaders  int           // This is how many peers we are downloading blocks from right now.
+	StartHeight  uint64        // This is our chain height when the download started.
+	TargetHeight uint64        // This is the height of the last header we are downloading towards.
+	Started      time.Time     // This is when the download started.
+}
+
+type BlockRange struct {
+	Start int // This is the index of the first header in the range.
+	End   int // This is the index just past the last header in the range.
+}
+
+type BlockFetch struct {
+	Peer   *Peer      // This is the peer the blocks were requested from.
+	Range  BlockRange // This is the range of headers that was requested.
+	Sent   time.Time  // This is when the request was sent.
+	Blocks []Block    // These are the blocks the peer sent back.
+	Err    error      // This is why the request failed, if it did.
+}
+
+type TokenBucket struct {
+	Mutex  *sync.Mutex // This is a mutex to ensure consistency when tokens are taken concurrently.
+	Rate   float64     // This is how many tokens are added each second.
+	Burst  float64     // This is the most tokens the bucket holds.
+	Tokens float64     // This is how many tokens are available. It goes negative when tokens are reserved ahead of time.
+	Last   time.Time   // This is when Tokens was last refilled.
+}
+
+type PeerLimits struct {
+	Download *TokenBucket                 // This is the peer's download quota in bytes. Exceeding it disconnects the peer.
+	Messages map[MessageType]*TokenBucket // These limit how many messages of each type the peer may send.
+	Mutex    *sync.Mutex                  // This guards Messages and the byte counters.
+	BytesIn  uint64                       // This is how many bytes we have read from the peer.
+	BytesOut uint64                       // This is how many bytes we have written to the peer.
+	Dropped  uint64                       // This is how many of the peer's messages we dropped for exceeding their rate limit.
+}
+
+type GlobalLimits struct {
+	Download *TokenBucket // This caps our total download rate in bytes, or is nil for no cap.
+	Upload   *TokenBucket // This caps our total upload rate in bytes, or is nil for no cap.
+}
+
+type Metrics struct {
+	Mutex                *sync.Mutex       // This is a mutex to ensure consistency when counters are updated concurrently.
+	BytesReceived        uint64            // This is how many bytes we have read from all peers.
+	BytesSent            uint64            // This is how many bytes we have written to all peers.
+	MessagesReceived     map[string]uint64 // This counts the messages we have received, by type.
+	MessagesDropped      map[string]uint64 // This counts the messages we dropped for exceeding a rate limit, by type.
+	BandwidthDisconnects uint64            // This counts the peers we disconnected for exceeding their download quota.
+	CompactBlocks        uint64            // This counts the compact blocks we rebuilt from our pending pool alone.
+	CompactBlockFetches  uint64            // This counts the compact blocks that needed missing transactions fetched.
+	CompactBlockFailures uint64            // This counts the compact blocks we could not rebuild and fetched in full.
+}
+
+type Ban struct {
+	Address string    // This is the banned IP address.
+	Reason  string    // This is why the address was banned.
+	Created time.Time // This is when the ban was created.
+	Expires time.Time // This is when the ban is lifted.
+}
+
+type IPScore struct {
+	Points  int       // This is the accumulated misbehavior score.
+	Updated time.Time // This is when Points was last changed.
+}
+
+type BanList struct {
+	Mutex    *sync.Mutex         `json:"-"` // This is a mutex to ensure consistency when updating scores and bans.
+	Path     string              `json:"-"` // This is the file the bans are persisted to.
+	Bans     map[string]*Ban     // These are the active bans, keyed by IP.
+	IPScores map[string]*IPScore `json:"-"` // These are the misbehavior scores of remote IPs.
+}
+
+type AddressEntry struct {
+	Address             net.IP      // This is the IP address we dial.
+	Port                uint16      // This is the port we dial.
+	NodeID              NodeID      // This is the NodeID last seen at this address.
+	Record              *PeerRecord // This is the most recent signed record for this address, if any.
+	Source              net.IP      // This is the IP of the peer that told us about this address.
+	Tried               bool        // This is true once we have connected to this address successfully.
+	Bucket              int         // This is the index of the new or tried bucket holding this entry.
+	Successes           uint64      // This is how many connections to this address have succeeded.
+	Failures            uint64      // This is how many connections to this address have failed.
+	ConsecutiveFailures uint        // This is how many connection attempts have failed since the last success.
+	LastAttempt         time.Time   // This is when we last tried to connect.
+	LastSuccess         time.Time   // This is when we last connected successfully.
+	LastSeen            time.Time   // This is when we last heard from or about this address.
+}
+
+type AddressBook struct {
+	Mutex   *sync.Mutex              `json:"-"` // This is a mutex to ensure consistency when updating entries.
+	Path    string                   `json:"-"` // This is the file the address book is persisted to.
+	Key     [32]byte                 // This is a random secret that makes bucket placement unpredictable to other nodes.
+	Entries map[string]*AddressEntry // These are the known addresses, keyed by host:port.
+}
+
+type SeenCache struct {
+	Mutex     *sync.Mutex        // This is a mutex to ensure consistency when checking and recording hashes.
+	Entries   map[Hash]time.Time // This maps each seen hash to when it was first seen.
+	TTL       time.Duration      // This is how long an entry is kept.
+	LastPrune time.Time          // This is when expired entries were last removed.
 }
 
 type Block struct {
@@ -104,9 +706,44 @@ type Block struct {
 	Timestamp    time.Time     // This is the timestamp of when this block was added to the chain.
 	Issuer       PublicKey     // This is who minted this block.
 	Signature    Signature     // This is the signature from the issuer of this block's contents.
+	StateRoot    Hash          // This is the Merkle root of the account state after this block, from BlockVersionMerkle on.
+	Target       Hash          // This is the proof of work target as a big-endian number, from BlockVersionWork on.
+	Vote         AuthorityVote // This is the issuer's vote on the authority set of a proof of authority chain, if any.
 	Transactions []Transaction // These are the transactions in this block.
 }
 
+type BlockHeader struct {
+	Height     uint64        // This is the block's height.
+	Nonce      Nonce         // This is the block's nonce.
+	BlockHash  Hash          // This is the hash of the block.
+	ParentHash Hash          // This is the hash of the previous block.
+	Version    uint64        // This is the block template version.
+	Timestamp  time.Time     // This is the block's timestamp.
+	Issuer     PublicKey     // This is who minted the block.
+	Signature  Signature     // This is the issuer's signature over the block hash.
+	TxHashes   []Hash        // These are the hashes of the block's transactions, in order. Before BlockVersionMerkle the block hash commits to them directly.
+	TxRoot     Hash          // This is the Merkle root of TxHashes, from BlockVersionMerkle on.
+	StateRoot  Hash          // This is the Merkle root of the account state after the block, from BlockVersionMerkle on.
+	Target     Hash          // This is the proof of work target as a big-endian number, from BlockVersionWork on.
+	Vote       AuthorityVote // This is the block's authority vote.
+}
+
+type CompactBlock struct {
+	Header   BlockHeader // This is the block header, without its TxHashes.
+	Salt     uint64      // This is mixed into the short IDs so that collisions can't be planned in advance.
+	ShortIDs []uint64    // These are the short IDs of the block's transactions, in order.
+}
+
+type MempoolRequest struct {
+	Salt     uint64   // This is mixed into the short IDs so that collisions can't be planned in advance.
+	ShortIDs []uint64 // These are the short IDs of the sender's pending transactions, which it doesn't need announced.
+}
+
+type GetBlockTxsRequest struct {
+	BlockHash Hash  // This is the compact block the transactions belong to.
+	Indexes   []int // These are the positions of the wanted transactions in the block.
+}
+
 type Transaction struct {
 	Nonce     Nonce     // This is the nonce for this transaction.
 	TxHash    Hash      // This is the hash of this tx.
@@ -118,12 +755,72 @@ type Transaction struct {
 	Signature Signature // This is the transaction signature from this Sender.
 }
 
+// Consensus decides how blocks are sealed, which blocks are valid beyond their own contents and which chain wins a fork.
+type Consensus interface {
+	// Prepare fills in the consensus fields of a new block on top of our tip. The caller must hold c.Mutex.
+	Prepare(c *Chain, block *Block) error
+	// Seal makes a prepared block valid, typically by signing it, giving up once ctx is cancelled.
+	Seal(ctx context.Context, block *Block, key PrivateKey) error
+	// Verify checks a block's consensus fields against its ancestors, which must be on our chain or on a side chain we hold.
+	// The caller must hold c.Mutex.
+	Verify(c *Chain, block *Block) error
+	// Work returns what a block adds to the weight of its chain for fork choice, or nil if we always keep the first chain we see.
+	Work(header *BlockHeader) *big.Int
+}
+
+// SignedConsensus accepts a block from any issuer whose signature checks out, and never switches chains.
+type SignedConsensus struct{}
+
+// ProofOfWork requires each block's hash to be at most its Target, and follows the chain with the most cumulative work.
+type ProofOfWork struct {
+	BlockTime time.Duration // This is the block interval the difficulty is retargeted towards.
+	Threads   int           // This is how many goroutines search for a nonce when we mine.
+}
+
+// ProofOfAuthority lets only the authority scheduled for a block's slot issue it. The authority set starts out as
+// defined in the genesis file and changes when more than half of the authorities vote for the same change.
+type ProofOfAuthority struct {
+	Genesis     *Genesis                             // This is the genesis file the chain started from.
+	Authorities []Authority                          // This is the authority set after the counted blocks, sorted by key.
+	Votes       map[AuthorityVote]map[PublicKey]bool // These are the authorities that voted for each change still open.
+	Counted     uint64                               // This is how many blocks of the chain Authorities and Votes take into account.
+	CountedHash Hash                                 // This is the hash of the last counted block, to notice the chain changing under us.
+	Proposals   map[PublicKey]uint64                 // These are the weights we vote for in the blocks we issue, by key.
+}
+
 type Chain struct {
-	FeeBasis            uint64        // This is the minimum fee amount.
-	BlockInterval       time.Time     // This is the minimum amount of time between blocks. Blocks may not be produced in less than this amount of time.
-	SuperBlockSize      uint16        // A single issuer consolidates their blocks into a compound block called a 'SuperBlock' consisting of this many normal blocks.
-	BlockHistory        []Block       // This is a list of blocks on the chain.
-	PendingTransactions []Transaction // This is a list of the transactions pending inclusion into a block.
+	FeeBasis            uint64                 // This is the minimum fee amount.
+	BlockInterval       time.Time              // This is the minimum amount of time between blocks. Blocks may not be produced in less than this amount of time.
+	SuperBlockSize      uint16                 // A single issuer consolidates their blocks into a compound block called a 'SuperBlock' consisting of this many normal blocks.
+	BlockHistory        []Block                // This is a list of blocks on the chain.
+	PendingTransactions []Transaction          // This is a list of the transactions pending inclusion into a block.
+	Mutex               *sync.Mutex            // This is a mutex to ensure consistency when the chain is updated from several peers.
+	State               map[PublicKey]*Account // This is the account state after the last block.
+	TxIndex             map[Hash]uint64        // This is the height of the block holding each transaction on the chain.
+	Filters             []BlockFilter          // These are the filters of the blocks in BlockHistory, in the same order.
+	Consensus           Consensus              // This decides which blocks are valid and which chain we follow.
+	Side                map[Hash]Block         // These are the valid blocks of competing chains, in case one of them overtakes ours.
+}
+
+type Genesis struct {
+	Start       time.Time     // This is when slot 0 begins.
+	Slot        time.Duration // This is the length of a slot, a whole number of seconds as block timestamps are.
+	Authorities []Authority   // These are the keys that may issue blocks from the first block on.
+}
+
+type Authority struct {
+	Key    PublicKey // This is the key the authority issues blocks with.
+	Weight uint64    // This is how many slots in a row the authority gets in each round of the schedule.
+}
+
+type AuthorityVote struct {
+	Key    PublicKey // This is the key the vote is about.
+	Weight uint64    // This is the weight the voter wants the key to have, 0 to remove it from the authority set.
+}
+
+type ChainState struct {
+	Blocks  []Block       // These are the blocks on the chain.
+	Pending []Transaction // These are the transactions pending inclusion into a block.
 }
 
 type KeyPair struct {
@@ -136,5 +833,11 @@ type DiscoverPeersRequest struct {
 }
 
 type DiscoverPeersResponse struct {
-	Peers []NodeID
+	Peers    []PeerRecord
+	Observed []ObservedPeer
+}
+
+type ObservedPeer struct {
+	Record  PeerRecord // This is the peer's signed record, which carries no address.
+	Address net.IP     // This is the IP the responder sees the peer connect from. The peer didn't sign it.
 }